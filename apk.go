@@ -0,0 +1,469 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	// maxAPKManifestSize is the largest binary AndroidManifest.xml
+	// we're willing to decompress
+	maxAPKManifestSize = 4 << 20
+
+	// android resource chunk types from
+	// frameworks/base/libs/androidfw/include/androidfw/ResourceTypes.h
+	resStringPoolType   = 0x0001
+	resXMLType          = 0x0003
+	resXMLStartElement  = 0x0102
+	resXMLResourceMap   = 0x0180
+	resStringPoolUTF8   = 1 << 8
+	resValueTypeString  = 0x03
+	resValueTypeIntDec  = 0x10
+	resValueTypeIntHex  = 0x11
+	resNoEntry          = 0xffffffff
+	resChunkHeaderSize  = 8
+	resXMLNodeSize      = 16
+	resXMLAttrExtSize   = 20
+	resXMLAttributeSize = 20
+
+	// android.R.attr resource IDs of the manifest attributes, used when
+	// attribute names have been stripped from the string pool
+	androidAttrVersionCode      = 0x0101021b
+	androidAttrVersionCodeMajor = 0x01010576
+)
+
+// apkManifest contains the AndroidManifest.xml fields we enforce
+// policies on
+type apkManifest struct {
+	Package     string
+	VersionCode int64
+}
+
+// binaryXMLAttribute is an attribute of a binary XML element with
+// its name resolved and its value as a raw string or typed integer
+type binaryXMLAttribute struct {
+	Name       string
+	ResourceID uint32
+	RawValue   string
+	HasRaw     bool
+	DataType   uint8
+	Data       uint32
+}
+
+// intValue returns the integer value of the attribute, parsing its
+// raw string value when it isn't stored as a typed integer
+func (a binaryXMLAttribute) intValue() (int64, error) {
+	switch a.DataType {
+	case resValueTypeIntDec, resValueTypeIntHex:
+		return int64(a.Data), nil
+	}
+	if a.HasRaw {
+		return strconv.ParseInt(a.RawValue, 0, 64)
+	}
+	return 0, fmt.Errorf("attribute %q is not an integer (type 0x%x)", a.Name, a.DataType)
+}
+
+// stringValue returns the string value of the attribute
+func (a binaryXMLAttribute) stringValue() (string, error) {
+	if a.HasRaw {
+		return a.RawValue, nil
+	}
+	return "", fmt.Errorf("attribute %q is not a string (type 0x%x)", a.Name, a.DataType)
+}
+
+// parseStringPool decodes the strings of a binary XML string pool chunk
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, fmt.Errorf("string pool chunk is too short")
+	}
+	var (
+		le           = binary.LittleEndian
+		headerSize   = uint32(le.Uint16(chunk[2:4]))
+		stringCount  = le.Uint32(chunk[8:12])
+		flags        = le.Uint32(chunk[16:20])
+		stringsStart = le.Uint32(chunk[20:24])
+	)
+	if uint64(headerSize)+uint64(stringCount)*4 > uint64(len(chunk)) || stringsStart > uint32(len(chunk)) {
+		return nil, fmt.Errorf("string pool offsets are out of bounds")
+	}
+	strs := make([]string, stringCount)
+	for i := range strs {
+		offset := uint64(stringsStart) + uint64(le.Uint32(chunk[headerSize+uint32(i)*4:]))
+		if offset >= uint64(len(chunk)) {
+			return nil, fmt.Errorf("string %d offset is out of bounds", i)
+		}
+		var err error
+		if flags&resStringPoolUTF8 != 0 {
+			strs[i], err = decodeUTF8PoolString(chunk[offset:])
+		} else {
+			strs[i], err = decodeUTF16PoolString(chunk[offset:])
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode string %d", i)
+		}
+	}
+	return strs, nil
+}
+
+// decodeUTF8PoolString decodes a string pool entry prefixed with its
+// UTF-16 and UTF-8 lengths, each encoded on one or two bytes
+func decodeUTF8PoolString(b []byte) (string, error) {
+	readLen := func(b []byte) (int, []byte, error) {
+		if len(b) < 1 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		if b[0]&0x80 == 0 {
+			return int(b[0]), b[1:], nil
+		}
+		if len(b) < 2 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return int(b[0]&0x7f)<<8 | int(b[1]), b[2:], nil
+	}
+	_, b, err := readLen(b)
+	if err != nil {
+		return "", err
+	}
+	n, b, err := readLen(b)
+	if err != nil {
+		return "", err
+	}
+	if n > len(b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(b[:n]), nil
+}
+
+// decodeUTF16PoolString decodes a string pool entry prefixed with its
+// length in UTF-16 code units, encoded on one or two uint16
+func decodeUTF16PoolString(b []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(b) < 2 {
+		return "", io.ErrUnexpectedEOF
+	}
+	n := int(le.Uint16(b))
+	b = b[2:]
+	if n&0x8000 != 0 {
+		if len(b) < 2 {
+			return "", io.ErrUnexpectedEOF
+		}
+		n = (n&0x7fff)<<16 | int(le.Uint16(b))
+		b = b[2:]
+	}
+	if n*2 > len(b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = le.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// parseBinaryXMLRootAttributes walks the chunks of an Android binary
+// XML document and returns the name and attributes of its root element
+func parseBinaryXMLRootAttributes(data []byte) (string, []binaryXMLAttribute, error) {
+	le := binary.LittleEndian
+	if len(data) < resChunkHeaderSize || le.Uint16(data[0:2]) != resXMLType {
+		return "", nil, fmt.Errorf("not an android binary XML document")
+	}
+	var (
+		strs        []string
+		resourceIDs []uint32
+		str         = func(idx uint32) (string, error) {
+			if idx == resNoEntry {
+				return "", nil
+			}
+			if idx >= uint32(len(strs)) {
+				return "", fmt.Errorf("string index %d is out of bounds", idx)
+			}
+			return strs[idx], nil
+		}
+	)
+	offset := uint64(le.Uint16(data[2:4]))
+	for offset+resChunkHeaderSize <= uint64(len(data)) {
+		chunkType := le.Uint16(data[offset:])
+		chunkSize := uint64(le.Uint32(data[offset+4:]))
+		if chunkSize < resChunkHeaderSize || offset+chunkSize > uint64(len(data)) {
+			return "", nil, fmt.Errorf("invalid chunk size %d at offset %d", chunkSize, offset)
+		}
+		chunk := data[offset : offset+chunkSize]
+		offset += chunkSize
+
+		switch chunkType {
+		case resStringPoolType:
+			var err error
+			strs, err = parseStringPool(chunk)
+			if err != nil {
+				return "", nil, err
+			}
+		case resXMLResourceMap:
+			headerSize := uint64(le.Uint16(chunk[2:4]))
+			for i := headerSize; i+4 <= chunkSize; i += 4 {
+				resourceIDs = append(resourceIDs, le.Uint32(chunk[i:]))
+			}
+		case resXMLStartElement:
+			if chunkSize < resXMLNodeSize+resXMLAttrExtSize {
+				return "", nil, fmt.Errorf("start element chunk is too short")
+			}
+			ext := chunk[resXMLNodeSize:]
+			name, err := str(le.Uint32(ext[4:8]))
+			if err != nil {
+				return "", nil, err
+			}
+			var (
+				attrStart = uint64(le.Uint16(ext[8:10]))
+				attrSize  = uint64(le.Uint16(ext[10:12]))
+				attrCount = uint64(le.Uint16(ext[12:14]))
+			)
+			if attrSize < resXMLAttributeSize || attrStart+attrSize*attrCount > uint64(len(ext)) {
+				return "", nil, fmt.Errorf("attributes of element %q are out of bounds", name)
+			}
+			attrs := make([]binaryXMLAttribute, attrCount)
+			for i := range attrs {
+				raw := ext[attrStart+uint64(i)*attrSize:]
+				nameIdx := le.Uint32(raw[4:8])
+				attrs[i].Name, err = str(nameIdx)
+				if err != nil {
+					return "", nil, err
+				}
+				if nameIdx < uint32(len(resourceIDs)) {
+					attrs[i].ResourceID = resourceIDs[nameIdx]
+				}
+				if rawIdx := le.Uint32(raw[8:12]); rawIdx != resNoEntry {
+					attrs[i].RawValue, err = str(rawIdx)
+					if err != nil {
+						return "", nil, err
+					}
+					attrs[i].HasRaw = true
+				}
+				attrs[i].DataType = raw[15]
+				attrs[i].Data = le.Uint32(raw[16:20])
+				if attrs[i].DataType == resValueTypeString && !attrs[i].HasRaw {
+					attrs[i].RawValue, err = str(attrs[i].Data)
+					if err != nil {
+						return "", nil, err
+					}
+					attrs[i].HasRaw = true
+				}
+			}
+			return name, attrs, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no root element found")
+}
+
+// parseAPKManifest extracts the package name and version code from
+// a binary AndroidManifest.xml
+func parseAPKManifest(data []byte) (manifest apkManifest, err error) {
+	name, attrs, err := parseBinaryXMLRootAttributes(data)
+	if err != nil {
+		return
+	}
+	if name != "manifest" {
+		err = fmt.Errorf("unexpected root element %q", name)
+		return
+	}
+	var versionCodeMajor int64
+	for _, attr := range attrs {
+		switch {
+		case attr.Name == "package" && attr.ResourceID == 0:
+			manifest.Package, err = attr.stringValue()
+		case attr.ResourceID == androidAttrVersionCode || (attr.ResourceID == 0 && attr.Name == "versionCode"):
+			manifest.VersionCode, err = attr.intValue()
+		case attr.ResourceID == androidAttrVersionCodeMajor || (attr.ResourceID == 0 && attr.Name == "versionCodeMajor"):
+			versionCodeMajor, err = attr.intValue()
+		}
+		if err != nil {
+			return
+		}
+	}
+	if manifest.Package == "" {
+		err = fmt.Errorf("manifest does not declare a package name")
+		return
+	}
+	// the long version code combines versionCodeMajor in the upper
+	// 32 bits with versionCode in the lower 32 bits
+	manifest.VersionCode = versionCodeMajor<<32 | manifest.VersionCode&0xffffffff
+	return
+}
+
+// readAPKManifest returns the package name and version code of an
+// APK from its binary AndroidManifest.xml
+func readAPKManifest(input *io.SectionReader) (apkManifest, error) {
+	apk, err := zip.NewReader(input, input.Size())
+	if err != nil {
+		return apkManifest{}, errors.Wrap(err, "failed to read zip archive")
+	}
+	for _, f := range apk.File {
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return apkManifest{}, errors.Wrap(err, "failed to open AndroidManifest.xml")
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, maxAPKManifestSize+1))
+		if err != nil {
+			return apkManifest{}, errors.Wrap(err, "failed to read AndroidManifest.xml")
+		}
+		if len(data) > maxAPKManifestSize {
+			return apkManifest{}, fmt.Errorf("AndroidManifest.xml is larger than %d bytes", maxAPKManifestSize)
+		}
+		manifest, err := parseAPKManifest(data)
+		if err != nil {
+			return apkManifest{}, errors.Wrap(err, "failed to parse AndroidManifest.xml")
+		}
+		return manifest, nil
+	}
+	return apkManifest{}, errAPKMissingManifest
+}
+
+// validateAPKManifest returns an error when the APK cannot be parsed
+// or its manifest does not satisfy the package name and minimum
+// version code policies of the authorization
+func validateAPKManifest(input *io.SectionReader, auth authorization) error {
+	manifest, err := readAPKManifest(input)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAPKInvalid, err)
+	}
+	if auth.APKPackageName != "" && manifest.Package != auth.APKPackageName {
+		return fmt.Errorf("%w: found %q expected %q", errAPKPackageMismatch, manifest.Package, auth.APKPackageName)
+	}
+	if manifest.VersionCode < auth.APKMinVersionCode {
+		return fmt.Errorf("%w: found %d expected at least %d", errAPKVersionCodeTooLow, manifest.VersionCode, auth.APKMinVersionCode)
+	}
+	return nil
+}
+
+// isAPKSignatureFile returns whether a file is part of an APK's v1
+// (JAR) signature, and therefore not covered by it
+func isAPKSignatureFile(name string) bool {
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "META-INF/") || strings.Contains(upper[len("META-INF/"):], "/") {
+		return false
+	}
+	return upper == "META-INF/MANIFEST.MF" ||
+		strings.HasPrefix(upper, "META-INF/SIG-") ||
+		strings.HasSuffix(upper, ".SF") ||
+		strings.HasSuffix(upper, ".RSA") ||
+		strings.HasSuffix(upper, ".DSA") ||
+		strings.HasSuffix(upper, ".EC")
+}
+
+// verifyAPKV1Signatures checks the JAR signatures of an APK: the PKCS7
+// signature of every signature file, the manifest digests they hold,
+// and that the manifest covers all other files. It returns whether the
+// APK has v1 signatures.
+func verifyAPKV1Signatures(contents zipContents) (signed bool, err error) {
+	var manifest []byte
+	for name, content := range contents.signatureFiles {
+		if strings.EqualFold(name, "META-INF/MANIFEST.MF") {
+			manifest = content
+		}
+	}
+	for name, sf := range contents.signatureFiles {
+		if !strings.HasSuffix(strings.ToUpper(name), ".SF") {
+			continue
+		}
+		base := name[:len(name)-len(".SF")]
+		var block []byte
+		for _, ext := range []string{".RSA", ".DSA", ".EC"} {
+			for blockName, content := range contents.signatureFiles {
+				if strings.EqualFold(blockName, base+ext) {
+					block = content
+				}
+			}
+		}
+		if block == nil {
+			return false, fmt.Errorf("no signature block for %s", name)
+		}
+		p7, err := pkcs7.Parse(block)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to parse signature block of %s", name)
+		}
+		p7.Content = sf
+		err = p7.Verify()
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid signature of %s", name)
+		}
+		if manifest == nil {
+			return false, fmt.Errorf("missing META-INF/MANIFEST.MF")
+		}
+		err = verifyJARSignatureFile(sf, manifest)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid %s", name)
+		}
+		signed = true
+	}
+	if !signed {
+		return false, nil
+	}
+	_, entries, err := parseJARManifest(manifest)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to parse META-INF/MANIFEST.MF")
+	}
+	err = verifyJARManifest(contents, "META-INF/MANIFEST.MF", entries, isAPKSignatureFile)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyAPKSignatures checks that a signed APK contains the files of
+// the input, and that its v1, v2 and v3 signatures are valid. At least
+// one of them is required.
+func verifyAPKSignatures(input, signed *io.SectionReader) error {
+	inputContents, err := readZipContents(input, isAPKSignatureFile)
+	if err != nil {
+		return err
+	}
+	contents, err := readZipContents(signed, isAPKSignatureFile)
+	if err != nil {
+		return err
+	}
+	err = compareZipContents(inputContents, contents)
+	if err != nil {
+		return err
+	}
+	v1, err := verifyAPKV1Signatures(contents)
+	if err != nil {
+		return errors.Wrap(err, "invalid v1 signature")
+	}
+	block, err := findAPKSigningBlock(signed)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		if !v1 {
+			return fmt.Errorf("APK is not signed")
+		}
+		return nil
+	}
+	v2, v3 := block.values[apkSignatureSchemeV2BlockID], block.values[apkSignatureSchemeV3BlockID]
+	if !v1 && v2 == nil && v3 == nil {
+		return fmt.Errorf("APK is not signed")
+	}
+	if v2 != nil {
+		err = verifyAPKSignatureSchemeBlock(signed, block, v2, false)
+		if err != nil {
+			return errors.Wrap(err, "invalid v2 signature")
+		}
+	}
+	if v3 != nil {
+		err = verifyAPKSignatureSchemeBlock(signed, block, v3, true)
+		if err != nil {
+			return errors.Wrap(err, "invalid v3 signature")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func Test_readAPKManifest(t *testing.T) {
+	testAPK, err := os.ReadFile("integration_test/test.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		input            []byte
+		expectedManifest apkManifest
+		wantErr          bool
+	}{
+		{
+			name:  "integration test APK",
+			input: testAPK,
+			expectedManifest: apkManifest{
+				Package:     "org.mozilla.focus",
+				VersionCode: 13472157,
+			},
+		},
+		{
+			name:    "not a zip file",
+			input:   []byte(";"),
+			wantErr: true,
+		},
+		{
+			name: "no manifest",
+			input: makeZip(t, map[string]string{
+				"classes.dex": "",
+			}),
+			wantErr: true,
+		},
+		{
+			name: "plaintext manifest",
+			input: makeZip(t, map[string]string{
+				"AndroidManifest.xml": `<manifest package="org.mozilla.focus" android:versionCode="1"/>`,
+			}),
+			wantErr: true,
+		},
+		{
+			name: "truncated binary manifest",
+			input: makeZip(t, map[string]string{
+				"AndroidManifest.xml": "\x03\x00\x08\x00\xff\xff\x00\x00\x01\x00\x1c\x00\xff\xff\x00\x00",
+			}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := readAPKManifest(sectionReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readAPKManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if manifest != tt.expectedManifest {
+				t.Fatalf("readAPKManifest() = %+v, expected %+v", manifest, tt.expectedManifest)
+			}
+		})
+	}
+}
+
+func Test_decodeUTF8PoolString(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "short lengths",
+			input:    []byte("\x03\x03foo\x00"),
+			expected: "foo",
+		},
+		{
+			name:     "two byte lengths",
+			input:    append([]byte("\x80\x03\x80\x03"), []byte("bar\x00")...),
+			expected: "bar",
+		},
+		{
+			name:    "truncated",
+			input:   []byte("\x03\x05foo"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeUTF8PoolString(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeUTF8PoolString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Fatalf("decodeUTF8PoolString() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_validateAPKManifest(t *testing.T) {
+	testAPK, err := os.ReadFile("integration_test/test.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		input       []byte
+		auth        authorization
+		expectedErr error
+	}{
+		{
+			name:        "matching package name",
+			input:       testAPK,
+			auth:        authorization{APKPackageName: "org.mozilla.focus"},
+			expectedErr: nil,
+		},
+		{
+			name:        "matching package name and version code at minimum",
+			input:       testAPK,
+			auth:        authorization{APKPackageName: "org.mozilla.focus", APKMinVersionCode: 13472157},
+			expectedErr: nil,
+		},
+		{
+			name:        "version code only",
+			input:       testAPK,
+			auth:        authorization{APKMinVersionCode: 1},
+			expectedErr: nil,
+		},
+		{
+			name:        "mismatched package name",
+			input:       testAPK,
+			auth:        authorization{APKPackageName: "org.mozilla.firefox"},
+			expectedErr: errAPKPackageMismatch,
+		},
+		{
+			name:        "downgraded version code",
+			input:       testAPK,
+			auth:        authorization{APKPackageName: "org.mozilla.focus", APKMinVersionCode: 13472158},
+			expectedErr: errAPKVersionCodeTooLow,
+		},
+		{
+			name:        "invalid APK",
+			input:       []byte(";"),
+			auth:        authorization{APKPackageName: "org.mozilla.focus"},
+			expectedErr: errAPKInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAPKManifest(sectionReader(tt.input), tt.auth)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("validateAPKManifest() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
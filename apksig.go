@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+)
+
+const (
+	// apkSigningBlockMagic ends the APK Signing Block that precedes
+	// the zip central directory
+	apkSigningBlockMagic = "APK Sig Block 42"
+
+	// apkSignatureSchemeV2BlockID and apkSignatureSchemeV3BlockID
+	// identify the signatures in the APK Signing Block
+	apkSignatureSchemeV2BlockID = 0x7109871a
+	apkSignatureSchemeV3BlockID = 0xf05368c0
+
+	// apkContentDigestChunkSize is the size of the chunks the APK
+	// contents are digested in
+	apkContentDigestChunkSize = 1 << 20
+
+	// zipEOCDSignature starts the zip end of central directory record
+	zipEOCDSignature = 0x06054b50
+	zipEOCDMinSize   = 22
+)
+
+// apkSignatureAlgorithm is a signature algorithm of the APK Signature
+// Schemes v2 and v3
+type apkSignatureAlgorithm struct {
+	name string
+	hash crypto.Hash
+}
+
+// apkSignatureAlgorithms are the supported signature algorithms by ID.
+// DSA and verity based algorithms aren't supported.
+var apkSignatureAlgorithms = map[uint32]apkSignatureAlgorithm{
+	0x0101: {"RSASSA-PSS with SHA2-256", crypto.SHA256},
+	0x0102: {"RSASSA-PSS with SHA2-512", crypto.SHA512},
+	0x0103: {"RSASSA-PKCS1-v1_5 with SHA2-256", crypto.SHA256},
+	0x0104: {"RSASSA-PKCS1-v1_5 with SHA2-512", crypto.SHA512},
+	0x0201: {"ECDSA with SHA2-256", crypto.SHA256},
+	0x0202: {"ECDSA with SHA2-512", crypto.SHA512},
+}
+
+// verify checks a signature of data made with the algorithm of ID id
+func (alg apkSignatureAlgorithm) verify(id uint32, publicKey interface{}, data, signature []byte) error {
+	h := alg.hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		switch id {
+		case 0x0101, 0x0102:
+			return rsa.VerifyPSS(pub, alg.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		case 0x0103, 0x0104:
+			return rsa.VerifyPKCS1v15(pub, alg.hash, digest, signature)
+		}
+	case *ecdsa.PublicKey:
+		if id == 0x0201 || id == 0x0202 {
+			if !ecdsa.VerifyASN1(pub, digest, signature) {
+				return fmt.Errorf("signature does not match")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%T public key for %s signature", publicKey, alg.name)
+}
+
+// apkSigReader reads the little endian, length prefixed values of the
+// APK Signing Block
+type apkSigReader struct {
+	b []byte
+}
+
+func (r *apkSigReader) empty() bool {
+	return len(r.b) == 0
+}
+
+func (r *apkSigReader) uint32() (uint32, error) {
+	if len(r.b) < 4 {
+		return 0, fmt.Errorf("truncated APK signature")
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, nil
+}
+
+func (r *apkSigReader) lengthPrefixed() ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > uint64(len(r.b)) {
+		return nil, fmt.Errorf("truncated APK signature")
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// apkSigningBlock is the location of the APK Signing Block and the zip
+// central directory of an APK, its end of central directory record,
+// and the values of the signing block by ID
+type apkSigningBlock struct {
+	offset, centralDirectoryOffset, eocdOffset int64
+	eocd                                       []byte
+	values                                     map[uint32][]byte
+}
+
+// findAPKSigningBlock returns the APK Signing Block of an APK, or nil
+// if it doesn't have one
+func findAPKSigningBlock(apk *io.SectionReader) (*apkSigningBlock, error) {
+	// the end of central directory record is at the end of the file,
+	// followed by a comment of up to 64KiB
+	tailSize := apk.Size()
+	if tailSize > zipEOCDMinSize+0xffff {
+		tailSize = zipEOCDMinSize + 0xffff
+	}
+	tail := make([]byte, tailSize)
+	_, err := apk.ReadAt(tail, apk.Size()-tailSize)
+	if err != nil {
+		return nil, err
+	}
+	eocdIndex := -1
+	for i := len(tail) - zipEOCDMinSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEOCDSignature &&
+			int(binary.LittleEndian.Uint16(tail[i+20:])) == len(tail)-i-zipEOCDMinSize {
+			eocdIndex = i
+			break
+		}
+	}
+	if eocdIndex < 0 {
+		return nil, fmt.Errorf("zip end of central directory not found")
+	}
+	eocdOffset := apk.Size() - tailSize + int64(eocdIndex)
+	eocd := tail[eocdIndex:]
+	cdOffset := int64(binary.LittleEndian.Uint32(eocd[16:]))
+	if cdOffset > eocdOffset {
+		return nil, fmt.Errorf("invalid zip central directory offset")
+	}
+	if cdOffset < 32 {
+		return nil, nil
+	}
+	footer := make([]byte, 24)
+	_, err = apk.ReadAt(footer, cdOffset-24)
+	if err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != apkSigningBlockMagic {
+		return nil, nil
+	}
+	size := binary.LittleEndian.Uint64(footer)
+	if size < 24 || size > uint64(cdOffset-8) {
+		return nil, fmt.Errorf("invalid APK Signing Block size %d", size)
+	}
+	if size > maxSignatureFileSize {
+		return nil, fmt.Errorf("APK Signing Block is larger than %d bytes", maxSignatureFileSize)
+	}
+	offset := cdOffset - int64(size) - 8
+	data := make([]byte, size-16)
+	_, err = apk.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(data) != size {
+		return nil, fmt.Errorf("APK Signing Block sizes do not match")
+	}
+	block := &apkSigningBlock{
+		offset:                 offset,
+		centralDirectoryOffset: cdOffset,
+		eocdOffset:             eocdOffset,
+		eocd:                   eocd,
+		values:                 make(map[uint32][]byte),
+	}
+	pairs := data[8:]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, fmt.Errorf("truncated APK Signing Block")
+		}
+		n := binary.LittleEndian.Uint64(pairs)
+		if n < 4 || n > uint64(len(pairs)-8) {
+			return nil, fmt.Errorf("invalid APK Signing Block value size %d", n)
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		block.values[id] = pairs[12 : 8+n]
+		pairs = pairs[8+n:]
+	}
+	return block, nil
+}
+
+// apkContentDigest returns the digest of the zip entries, central
+// directory and end of central directory of an APK, with the central
+// directory offset of the latter pointing to the APK Signing Block, as
+// covered by APK Signature Scheme v2 and v3 signatures
+func apkContentDigest(apk *io.SectionReader, block *apkSigningBlock, newHash func() hash.Hash) ([]byte, error) {
+	eocd := append([]byte{}, block.eocd...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(block.offset))
+
+	var chunkDigests []byte
+	chunks := uint32(0)
+	chunk := make([]byte, apkContentDigestChunkSize)
+	for _, section := range []*io.SectionReader{
+		io.NewSectionReader(apk, 0, block.offset),
+		io.NewSectionReader(apk, block.centralDirectoryOffset, block.eocdOffset-block.centralDirectoryOffset),
+		io.NewSectionReader(bytes.NewReader(eocd), 0, int64(len(eocd))),
+	} {
+		for {
+			n, err := io.ReadFull(section, chunk)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			h := newHash()
+			h.Write([]byte{0xa5})
+			binary.Write(h, binary.LittleEndian, uint32(n))
+			h.Write(chunk[:n])
+			chunkDigests = h.Sum(chunkDigests)
+			chunks++
+		}
+	}
+	h := newHash()
+	h.Write([]byte{0x5a})
+	binary.Write(h, binary.LittleEndian, chunks)
+	h.Write(chunkDigests)
+	return h.Sum(nil), nil
+}
+
+// verifyAPKSignatureSchemeBlock checks the signers of an APK Signature
+// Scheme v2 or v3 block: their signatures of the signed data with
+// their public key, that it's the key of their first certificate, and
+// that the signed content digests match the APK
+func verifyAPKSignatureSchemeBlock(apk *io.SectionReader, block *apkSigningBlock, value []byte, v3 bool) error {
+	contentDigests := map[crypto.Hash][]byte{}
+	contentDigest := func(h crypto.Hash) (digest []byte, err error) {
+		if _, done := contentDigests[h]; !done {
+			newHash := sha256.New
+			if h == crypto.SHA512 {
+				newHash = sha512.New
+			}
+			contentDigests[h], err = apkContentDigest(apk, block, newHash)
+		}
+		return contentDigests[h], err
+	}
+
+	r := &apkSigReader{value}
+	seq, err := r.lengthPrefixed()
+	if err != nil {
+		return err
+	}
+	signers := &apkSigReader{seq}
+	if signers.empty() {
+		return fmt.Errorf("no signers")
+	}
+	for i := 0; !signers.empty(); i++ {
+		b, err := signers.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		signer := &apkSigReader{b}
+		signedData, err := signer.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		if v3 {
+			// skip the minimum and maximum SDK versions
+			_, err = signer.uint32()
+			if err == nil {
+				_, err = signer.uint32()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		signatures, err := signer.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		publicKeyDER, err := signer.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(publicKeyDER)
+		if err != nil {
+			return fmt.Errorf("failed to parse public key of signer %d: %v", i, err)
+		}
+
+		var signedAlgorithms []uint32
+		sigs := &apkSigReader{signatures}
+		for !sigs.empty() {
+			b, err := sigs.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			sig := &apkSigReader{b}
+			id, err := sig.uint32()
+			if err != nil {
+				return err
+			}
+			signature, err := sig.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			alg, supported := apkSignatureAlgorithms[id]
+			if !supported {
+				continue
+			}
+			err = alg.verify(id, publicKey, signedData, signature)
+			if err != nil {
+				return fmt.Errorf("invalid %s signature of signer %d: %v", alg.name, i, err)
+			}
+			signedAlgorithms = append(signedAlgorithms, id)
+		}
+		if len(signedAlgorithms) == 0 {
+			return fmt.Errorf("no supported signature for signer %d", i)
+		}
+
+		data := &apkSigReader{signedData}
+		digests, err := data.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		certificates, err := data.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		var digestAlgorithms []uint32
+		ds := &apkSigReader{digests}
+		for !ds.empty() {
+			b, err := ds.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			d := &apkSigReader{b}
+			id, err := d.uint32()
+			if err != nil {
+				return err
+			}
+			digest, err := d.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			digestAlgorithms = append(digestAlgorithms, id)
+			alg, supported := apkSignatureAlgorithms[id]
+			if !supported {
+				continue
+			}
+			expected, err := contentDigest(alg.hash)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(digest, expected) {
+				return fmt.Errorf("%s content digest of signer %d does not match", alg.name, i)
+			}
+		}
+		// every signature must have a digest, otherwise an
+		// attacker could strip the strongest digest
+		supportedDigests := digestAlgorithms[:0:0]
+		for _, id := range digestAlgorithms {
+			if _, supported := apkSignatureAlgorithms[id]; supported {
+				supportedDigests = append(supportedDigests, id)
+			}
+		}
+		sort.Slice(signedAlgorithms, func(a, b int) bool { return signedAlgorithms[a] < signedAlgorithms[b] })
+		sort.Slice(supportedDigests, func(a, b int) bool { return supportedDigests[a] < supportedDigests[b] })
+		if fmt.Sprint(signedAlgorithms) != fmt.Sprint(supportedDigests) {
+			return fmt.Errorf("signature and digest algorithms of signer %d do not match", i)
+		}
+
+		certs := &apkSigReader{certificates}
+		first, err := certs.lengthPrefixed()
+		if err != nil {
+			return fmt.Errorf("no certificate for signer %d", i)
+		}
+		cert, err := x509.ParseCertificate(first)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate of signer %d: %v", i, err)
+		}
+		if !bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKeyDER) {
+			return fmt.Errorf("public key of signer %d does not match its certificate", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAuditRecordSize is the size of the largest audit log line read
+const maxAuditRecordSize = 1 << 20
+
+// the events of audit records
+const (
+	auditEventSign           = "sign"
+	auditEventSignFailed     = "sign_failed"
+	auditEventClientIPDenied = "client_ip_denied"
+)
+
+// auditRecord is a line of the audit log. Hash is the hex encoded
+// SHA-256 of the JSON encoding of the record without it, and PrevHash
+// the Hash of the previous record, so editing, inserting or removing
+// records breaks the chain.
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	RequestID    string    `json:"rid"`
+	Credential   string    `json:"credential,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Signer       string    `json:"signer,omitempty"`
+	AddonID      string    `json:"addon_id,omitempty"`
+	ClientIP     string    `json:"client_ip,omitempty"`
+	InputSHA256  string    `json:"input_sha256,omitempty"`
+	OutputSHA256 string    `json:"output_sha256,omitempty"`
+	Ref          string    `json:"ref,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash,omitempty"`
+}
+
+// hash returns the hash of a record
+func (rec auditRecord) hash() (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog appends hash chained records to a sink as JSON lines. size
+// is the length of the complete records in the sink, and err the
+// failed write that made the log unusable.
+type auditLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	size     int64
+	lastHash string
+	err      error
+}
+
+// truncater is implemented by sinks that can undo failed writes
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// openAuditLog opens the audit log file at path for appending, and
+// continues the hash chain of its last record
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	lastHash, err := lastAuditHash(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read audit log %q: %w", path, err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read audit log %q: %w", path, err)
+	}
+	return &auditLog{w: syncWriter{f}, size: size, lastHash: lastHash}, nil
+}
+
+// syncWriter flushes every write of a file to disk
+type syncWriter struct {
+	f *os.File
+}
+
+func (sw syncWriter) Write(p []byte) (int, error) {
+	n, err := sw.f.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, sw.f.Sync()
+}
+
+func (sw syncWriter) Truncate(size int64) error {
+	err := sw.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return sw.f.Sync()
+}
+
+// lastAuditHash returns the hash of the last record of an audit log
+func lastAuditHash(r io.Reader) (string, error) {
+	var lastHash string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAuditRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		var rec auditRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return "", fmt.Errorf("invalid record on line %d: %w", line, err)
+		}
+		lastHash = rec.Hash
+	}
+	return lastHash, scanner.Err()
+}
+
+// append chains a record to the previous one and writes it. It does
+// nothing on a nil audit log, and fails once the log is unusable.
+func (a *auditLog) append(rec *auditRecord) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return fmt.Errorf("audit log is unusable after a failed write: %w", a.err)
+	}
+	rec.PrevHash = a.lastHash
+	hash, err := rec.hash()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	n, err := a.w.Write(append(data, '\n'))
+	if err != nil {
+		err = fmt.Errorf("failed to write audit record: %w", err)
+		a.rollback(err)
+		return err
+	}
+	a.size += int64(n)
+	a.lastHash = hash
+	return nil
+}
+
+// rollback truncates the sink back to its last complete record after a
+// failed write, so that part of the record doesn't corrupt the next
+// one. The log becomes unusable when the sink can't be truncated.
+func (a *auditLog) rollback(writeErr error) {
+	t, ok := a.w.(truncater)
+	if !ok {
+		a.err = writeErr
+		return
+	}
+	err := t.Truncate(a.size)
+	if err != nil {
+		a.err = fmt.Errorf("%v and failed to truncate it: %w", writeErr, err)
+	}
+}
+
+// verifyAuditLog checks the hash chain of an audit log, and returns its
+// number of records and the hash of the last one
+func verifyAuditLog(r io.Reader) (records int, lastHash string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAuditRecordSize)
+	for scanner.Scan() {
+		records++
+		var rec auditRecord
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return records, lastHash, fmt.Errorf("record %d is invalid: %w", records, err)
+		}
+		// records must be written as they are encoded, so fields
+		// can't be added or reformatted without changing the hash
+		encoded, err := json.Marshal(rec)
+		if err != nil {
+			return records, lastHash, err
+		}
+		if !bytes.Equal(encoded, scanner.Bytes()) {
+			return records, lastHash, fmt.Errorf("record %d was modified: it isn't in the format it was written in", records)
+		}
+		hash, err := rec.hash()
+		if err != nil {
+			return records, lastHash, err
+		}
+		if rec.Hash != hash {
+			return records, lastHash, fmt.Errorf("record %d was modified: its hash is %s but it should be %s", records, rec.Hash, hash)
+		}
+		if rec.PrevHash != lastHash {
+			return records, lastHash, fmt.Errorf("record %d doesn't follow the previous record: records were removed, inserted or reordered", records)
+		}
+		lastHash = hash
+	}
+	return records, lastHash, scanner.Err()
+}
+
+// verifyAuditCommand runs the verify-audit subcommand, which checks
+// the audit log files given as arguments, and returns its exit code
+func verifyAuditCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: autograph-edge verify-audit <audit log>...")
+		return 2
+	}
+	status := 0
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		records, lastHash, err := verifyAuditLog(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d records verified, last hash %s\n", path, records, lastHash)
+	}
+	return status
+}
+
+// credentialID returns the identifier of the credential an authorized
+// request used, as in credentialIDs
+func (auth authorization) credentialID(authHeader string, clientCert *x509.Certificate) string {
+	if authHeader == "" && clientCert != nil {
+		return "client cert spki " + spkiFingerprint(clientCert)
+	}
+	for _, token := range auth.clientTokens() {
+		if token.matches(authHeader) {
+			return "client token " + token.fingerprint()
+		}
+	}
+	// the only other credential in the Authorization header is an OIDC
+	// identity token, and those are identified by claims
+	for _, id := range auth.credentialIDs() {
+		if strings.HasPrefix(id, "OIDC claims ") {
+			return id
+		}
+	}
+	return ""
+}
+
+// newAuditRecord returns a record of an event of an authorized request
+func newAuditRecord(r *http.Request, auth authorization, event string) auditRecord {
+	rec := auditRecord{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		RequestID:  getRequestID(r),
+		Credential: auth.credentialID(r.Header.Get("Authorization"), verifiedClientCert(r.TLS)),
+		User:       auth.User,
+		Signer:     auth.Signer,
+		AddonID:    auth.AddonID,
+	}
+	if ca := getClientAddress(r); ca.err == nil {
+		rec.ClientIP = ca.ip.String()
+	}
+	return rec
+}
+
+// audit records a security relevant event in the audit log, if there
+// is one, and in the logs
+func audit(rec auditRecord) error {
+	err := conf.auditLog.append(&rec)
+	if err != nil {
+		log.WithFields(log.Fields{"rid": rec.RequestID}).Errorf("failed to audit %s: %s", rec.Event, err)
+	}
+	log.WithFields(log.Fields{
+		"audit":         true,
+		"rid":           rec.RequestID,
+		"credential":    rec.Credential,
+		"user":          rec.User,
+		"signer":        rec.Signer,
+		"addon_id":      rec.AddonID,
+		"client_ip":     rec.ClientIP,
+		"input_sha256":  rec.InputSHA256,
+		"output_sha256": rec.OutputSHA256,
+		"ref":           rec.Ref,
+		"error":         rec.Error,
+		"audit_hash":    rec.Hash,
+	}).Info(rec.Event)
+	return err
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestAuditLog appends records to a new audit log file and returns
+// its lines
+func writeTestAuditLog(t *testing.T, path string, events ...string) []string {
+	t.Helper()
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		err = a.append(&auditRecord{Time: time.Now().UTC(), Event: event, RequestID: "rid", User: "alice", InputSHA256: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestAuditLog(t, path, auditEventSign, auditEventSignFailed)
+	// reopening the log continues the chain
+	lines := writeTestAuditLog(t, path, auditEventSign)
+	if len(lines) != 3 {
+		t.Fatalf("audit log has %d lines expected 3", len(lines))
+	}
+	records, lastHash, err := verifyAuditLog(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last auditRecord
+	json.Unmarshal([]byte(lines[2]), &last)
+	if records != 3 || lastHash != last.Hash {
+		t.Fatalf("verifyAuditLog() = %d, %s expected 3, %s", records, lastHash, last.Hash)
+	}
+
+	// rehash returns a line with the hash of its modified record updated
+	rehash := func(line string) string {
+		var rec auditRecord
+		json.Unmarshal([]byte(line), &rec)
+		rec.Hash, _ = rec.hash()
+		data, _ := json.Marshal(rec)
+		return string(data)
+	}
+	modified := strings.Replace(lines[1], `"user":"alice"`, `"user":"mallory"`, 1)
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"modified record", []string{lines[0], modified, lines[2]}},
+		{"modified and rehashed record", []string{lines[0], rehash(modified), lines[2]}},
+		{"added field", []string{lines[0], strings.Replace(lines[1], `"user"`, `"note":"x","user"`, 1), lines[2]}},
+		{"reformatted record", []string{lines[0], strings.Replace(lines[1], `,"user"`, `, "user"`, 1), lines[2]}},
+		{"removed record", []string{lines[0], lines[2]}},
+		{"removed first record", []string{lines[1], lines[2]}},
+		{"reordered records", []string{lines[1], lines[0], lines[2]}},
+		{"duplicated record", []string{lines[0], lines[1], lines[1], lines[2]}},
+		{"truncated record", []string{lines[0], lines[1], lines[2][:len(lines[2])/2]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := verifyAuditLog(strings.NewReader(strings.Join(tt.lines, "\n") + "\n"))
+			if err == nil {
+				t.Fatal("verifyAuditLog() expected an error")
+			}
+		})
+	}
+
+	// logs with a truncated last record can't be appended to
+	err = os.WriteFile(path, []byte(lines[0]+"\n"+lines[1][:10]), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openAuditLog(path)
+	if err == nil {
+		t.Fatal("openAuditLog() of a truncated log expected an error")
+	}
+}
+
+func TestVerifyAuditCommand(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.log")
+	writeTestAuditLog(t, valid, auditEventSign, auditEventSign)
+	tampered := filepath.Join(dir, "tampered.log")
+	lines := writeTestAuditLog(t, tampered, auditEventSign, auditEventSign)
+	err := os.WriteFile(tampered, []byte(lines[1]+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+	}{
+		{"valid", []string{valid}, 0},
+		{"tampered", []string{valid, tampered}, 1},
+		{"missing", []string{filepath.Join(dir, "missing.log")}, 1},
+		{"no arguments", nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := verifyAuditCommand(tt.args)
+			if code != tt.expectedCode {
+				t.Fatalf("verifyAuditCommand() = %d expected %d", code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func Test_credentialID(t *testing.T) {
+	ca, caKey := makeTestCert(t, "test CA", nil, nil)
+	cert, _ := makeTestCert(t, "ci", ca, caKey)
+	token := conf.Authorizations[4].ClientTokens[1]
+	tests := []struct {
+		name       string
+		auth       authorization
+		authHeader string
+		expected   string
+	}{
+		{"client token", conf.Authorizations[0], conf.Authorizations[0].ClientToken, "client token " + conf.Authorizations[0].clientTokens()[0].fingerprint()},
+		{"one of the client tokens", conf.Authorizations[4], token.ClientToken, "client token " + token.fingerprint()},
+		{"client certificate", authorization{ClientCertSubjects: []string{cert.Subject.String()}}, "", "client cert spki " + spkiFingerprint(cert)},
+		{"OIDC", authorization{OIDCClaims: map[string]string{"repository": "mozilla/addon"}}, "eyJ.eyJ.sig", `OIDC claims repository="mozilla/addon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := tt.auth.credentialID(tt.authHeader, cert)
+			if id != tt.expected {
+				t.Fatalf("credentialID() = %q expected %q", id, tt.expected)
+			}
+		})
+	}
+}
+
+// partialWriter writes half of what it's given and fails while
+// failing is set
+type partialWriter struct {
+	io.Writer
+	failing bool
+}
+
+func (pw *partialWriter) Write(p []byte) (int, error) {
+	if !pw.failing {
+		return pw.Writer.Write(p)
+	}
+	n, _ := pw.Writer.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+// truncatingWriter is a partialWriter of an audit log file
+type truncatingWriter struct {
+	*partialWriter
+	syncWriter
+}
+
+func (tw truncatingWriter) Write(p []byte) (int, error) {
+	return tw.partialWriter.Write(p)
+}
+
+func TestAuditLogFailedWrite(t *testing.T) {
+	rec := func() *auditRecord {
+		return &auditRecord{Time: time.Now().UTC(), Event: auditEventSign, RequestID: "rid", User: "alice"}
+	}
+
+	// partial records are truncated from files
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := a.w.(syncWriter)
+	pw := &partialWriter{Writer: sw}
+	a.w = truncatingWriter{pw, sw}
+	for _, failing := range []bool{false, true, false} {
+		pw.failing = failing
+		err = a.append(rec())
+		if (err != nil) != failing {
+			t.Fatalf("append() error = %v expected an error %t", err, failing)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := verifyAuditLog(bytes.NewReader(data))
+	if err != nil || records != 2 {
+		t.Fatalf("verifyAuditLog() = %d, %v expected 2 records", records, err)
+	}
+	_, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog() after a failed write error = %v", err)
+	}
+
+	// and sinks that can't be truncated make the log unusable
+	var buf bytes.Buffer
+	pw = &partialWriter{Writer: &buf, failing: true}
+	a = &auditLog{w: pw}
+	err = a.append(rec())
+	if err == nil {
+		t.Fatal("append() expected an error")
+	}
+	written := buf.Len()
+	pw.failing = false
+	err = a.append(rec())
+	if err == nil {
+		t.Fatal("append() after a partial write expected an error")
+	}
+	if buf.Len() != written {
+		t.Fatalf("append() after a partial write wrote %q", buf.Bytes()[written:])
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestSigHandlerAudit(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+	failingAutograph := newTestAutograph(t, auth, testAutographResponse{tamperedBody: true})
+	defer failingAutograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+
+	tests := []struct {
+		name          string
+		autograph     string
+		sink          func(*bytes.Buffer) *auditLog
+		expectedCode  int
+		expectedEvent string
+	}{
+		{"signed", autograph.URL, func(b *bytes.Buffer) *auditLog { return &auditLog{w: b} }, http.StatusCreated, auditEventSign},
+		{"signing failed", failingAutograph.URL, func(b *bytes.Buffer) *auditLog { return &auditLog{w: b} }, http.StatusBadGateway, auditEventSignFailed},
+		{"audit failed", autograph.URL, func(*bytes.Buffer) *auditLog { return &auditLog{w: failingWriter{}} }, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sink bytes.Buffer
+			conf.auditLog = tt.sink(&sink)
+			conf.BaseURL = tt.autograph + "/"
+			conf.upstream = newUpstreamClient(conf)
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("input", "app.apk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("unsigned"))
+			mw.Close()
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("Authorization", auth.ClientToken)
+			w := httptest.NewRecorder()
+			handleWithMiddleware(http.HandlerFunc(sigHandler), setRequestID()).ServeHTTP(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d", w.Code, tt.expectedCode)
+			}
+			if tt.expectedEvent == "" {
+				return
+			}
+			var rec auditRecord
+			err = json.Unmarshal(sink.Bytes(), &rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unsignedSHA256 := "ceffe727ab2fa2c7c3322ee4a1aa0c2d2a4664836c2133df93dd15055bb617be"
+			if rec.Event != tt.expectedEvent || rec.RequestID == "-" || rec.User != auth.User || rec.Signer != auth.Signer ||
+				rec.Credential != "client token "+auth.clientTokens()[0].fingerprint() || rec.ClientIP != "192.0.2.1" ||
+				rec.InputSHA256 != unsignedSHA256 {
+				t.Fatalf("sigHandler audited %s", sink.String())
+			}
+			if tt.expectedEvent == auditEventSign && (rec.OutputSHA256 != unsignedSHA256 || rec.Ref != "7khgpu4gcfdv30w8joqxjy1cc") {
+				t.Fatalf("sigHandler audited output %q and ref %q", rec.OutputSHA256, rec.Ref)
+			}
+			if tt.expectedEvent == auditEventSignFailed && rec.Error == "" {
+				t.Fatal("sigHandler audited a failed signing without its error")
+			}
+		})
+	}
+}
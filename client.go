@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"go.mozilla.org/hawk"
 )
@@ -41,10 +43,12 @@ type xpiOptions struct {
 	PKCS7Digest string `json:"pkcs7_digest"`
 }
 
-func callAutograph(auth authorization, body []byte, xff string) (signedBody []byte, err error) {
-	var requests []signaturerequest
+// callAutograph signs the input with autograph, streaming the request
+// and the signed file written to signedFile so neither is held in
+// memory. It returns the rest of the autograph response. The signed
+// file must be discarded when it returns an error.
+func callAutograph(ctx context.Context, auth authorization, input *io.SectionReader, xff string, signedFile io.Writer) (response signatureresponse, err error) {
 	request := signaturerequest{
-		Input: base64.StdEncoding.EncodeToString(body),
 		KeyID: auth.Signer,
 	}
 	if auth.AddonID != "" {
@@ -60,16 +64,131 @@ func callAutograph(auth authorization, body []byte, xff string) (signedBody []by
 		}
 		request.Options = opt
 	}
-	requests = append(requests, request)
-	reqBody, err := json.Marshal(requests)
+	reqBody, reqLength, err := signatureRequestBody(request, input)
 	if err != nil {
 		return
 	}
-	rdr := bytes.NewReader(reqBody)
-	req, err := http.NewRequest(http.MethodPost, conf.BaseURL+"sign/file", rdr)
+	// make the request, with a new hawk auth header for every attempt.
+	// hawkAuth is the one of the last attempt, which got the response.
+	var hawkAuth *hawk.Auth
+	resp, err := conf.upstream.do(ctx, func(ctx context.Context, baseURL string) (req *http.Request, err error) {
+		req, hawkAuth, err = newAutographSignRequest(ctx, baseURL, auth, reqBody, reqLength, xff)
+		return
+	})
 	if err != nil {
 		return
 	}
+	if resp == nil {
+		err = errAutographEmptyResponse
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		err = newAutographStatusError(resp)
+		return
+	}
+	err = validateAutographResponse(hawkAuth, resp, func(body io.Reader) (err error) {
+		response, err = decodeSignatureResponse(body, signedFile)
+		return err
+	})
+	return
+}
+
+const (
+	// maxAutographErrorBodySize is the size of the largest part of the
+	// body of an autograph error response that is read
+	maxAutographErrorBodySize = 4 << 10
+
+	// maxAutographErrorMessageLength is the largest number of characters
+	// of an autograph error message that is kept
+	maxAutographErrorMessageLength = 200
+)
+
+// autographStatusError is the error of an autograph response with a
+// status other than 201, with its sanitized message
+type autographStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+// newAutographStatusError returns the error of an autograph response,
+// reading the start of its body as its message
+func newAutographStatusError(resp *http.Response) *autographStatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxAutographErrorBodySize))
+	return &autographStatusError{
+		StatusCode: resp.StatusCode,
+		Message:    sanitizeAutographError(body),
+	}
+}
+
+func (e *autographStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: status code %d", errAutographBadStatusCode, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: status code %d: %s", errAutographBadStatusCode, e.StatusCode, e.Message)
+}
+
+func (e *autographStatusError) Unwrap() error {
+	return errAutographBadStatusCode
+}
+
+// clientError returns the status, code and message of the response to
+// a client whose signing got the error. Only errors that can go away
+// on their own are retryable.
+func (e *autographStatusError) clientError() (status int, code, message string) {
+	switch {
+	case e.StatusCode == http.StatusBadRequest:
+		// the input was rejected, which the client can fix
+		message = "autograph rejected the input"
+		if e.Message != "" {
+			message += ": " + e.Message
+		}
+		return http.StatusBadRequest, codeAutographRejectedInput, message
+	case e.StatusCode == http.StatusRequestEntityTooLarge:
+		return http.StatusRequestEntityTooLarge, codeInputTooLarge, "input is too large for autograph"
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		// the credentials of the edge are misconfigured
+		return http.StatusBadGateway, codeAutographUnauthorized, "autograph refused the authorization of the edge"
+	case e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable:
+		return http.StatusServiceUnavailable, codeAutographUnavailable, "autograph is overloaded, try again later"
+	case e.StatusCode >= http.StatusInternalServerError:
+		return http.StatusBadGateway, codeAutographError, "failed to call autograph for signature"
+	default:
+		return http.StatusBadGateway, codeAutographRequestRejected, "failed to call autograph for signature"
+	}
+}
+
+// sanitizeAutographError returns an autograph error message that is safe
+// to log and return to clients: valid UTF-8 without control characters
+// or repeated whitespace, truncated to maxAutographErrorMessageLength
+// characters
+func sanitizeAutographError(body []byte) string {
+	message := strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(string(body), " "))
+	message = strings.Join(strings.Fields(message), " ")
+	if utf8.RuneCountInString(message) > maxAutographErrorMessageLength {
+		message = string([]rune(message)[:maxAutographErrorMessageLength]) + "..."
+	}
+	return message
+}
+
+// newAutographSignRequest returns a /sign/file request for the autograph
+// at baseURL with a hawk authorization for the body, and the hawk auth
+// to validate the response with. reqBody returns a new reader of the
+// body of length reqLength every time it's called.
+func newAutographSignRequest(ctx context.Context, baseURL string, auth authorization, reqBody func() io.Reader, reqLength int64, xff string) (*http.Request, *hawk.Auth, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"sign/file", reqBody())
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = reqLength
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(reqBody()), nil
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// make the hawk auth header
@@ -81,43 +200,52 @@ func callAutograph(auth authorization, body []byte, xff string) (signedBody []by
 		0)
 	hawkAuth.Ext = fmt.Sprintf("%d", time.Now().Nanosecond())
 	payloadhash := hawkAuth.PayloadHash("application/json")
-	payloadhash.Write(reqBody)
+	_, err = io.Copy(payloadhash, reqBody())
+	if err != nil {
+		return nil, nil, err
+	}
 	hawkAuth.SetHash(payloadhash)
 	req.Header.Set("Authorization", hawkAuth.RequestHeader())
 
 	// Reuse the X-Forwarded-For received from the client over to
 	// autograph so we can trace requests back to client from its logs
 	req.Header.Set("X-Forwarded-For", xff)
+	return req, hawkAuth, nil
+}
 
-	// make the request
-	cli := &http.Client{}
-	resp, err := cli.Do(req)
+// validateAutographResponse checks that the hawk Server-Authorization
+// header of an autograph response was made with the credentials of the
+// request, and that its payload hash matches the response body, which
+// is streamed to decode as it's hashed. Responses without one are
+// rejected, and what decode produced must then be discarded.
+func validateAutographResponse(hawkAuth *hawk.Auth, resp *http.Response, decode func(body io.Reader) error) error {
+	// the payload hash must come from the response header, not the
+	// request
+	hawkAuth.Hash = nil
+	err := hawkAuth.ValidResponse(resp.Header.Get("Server-Authorization"))
 	if err != nil {
-		return
+		return fmt.Errorf("%w: %v", errAutographInvalidResponseAuth, err)
 	}
-	if resp == nil {
-		err = errAutographEmptyResponse
-		return
+	if len(hawkAuth.Hash) == 0 {
+		return fmt.Errorf("%w: missing payload hash", errAutographInvalidResponseAuth)
 	}
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		return
-	}
-	if resp.StatusCode != http.StatusCreated {
-		err = errAutographBadStatusCode
-		return
+		return fmt.Errorf("%w: invalid content type: %v", errAutographInvalidResponseAuth, err)
 	}
-	var responses []signatureresponse
-	err = json.Unmarshal(respBody, &responses)
+	payloadHash := hawkAuth.PayloadHash(contentType)
+	body := io.TeeReader(resp.Body, payloadHash)
+	decodeErr := decode(body)
+	// hash the rest of the body, an invalid authorization takes
+	// precedence over decoding errors
+	_, err = io.Copy(io.Discard, body)
 	if err != nil {
-		return
+		return err
 	}
-	if len(responses) != 1 {
-		err = errAutographBadResponseCount
-		return
+	if !hawkAuth.ValidHash(payloadHash) {
+		return fmt.Errorf("%w: payload hash does not match the response body", errAutographInvalidResponseAuth)
 	}
-	return base64.StdEncoding.DecodeString(responses[0].SignedFile)
+	return decodeErr
 }
 
 type heartbeatRequester interface {
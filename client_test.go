@@ -1,9 +1,211 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"go.mozilla.org/hawk"
 )
 
+// testAutographResponse controls how newTestAutograph authenticates
+// its response
+type testAutographResponse struct {
+	key          string
+	omitAuth     bool
+	omitHash     bool
+	tamperedBody bool
+	// nestedBody adds a field nested deeper than maxJSONDepth
+	nestedBody bool
+	// status and errorBody make the server respond with an error
+	status    int
+	errorBody string
+}
+
+// newTestAutograph returns a server that checks the hawk authorization
+// of /sign/file requests and responds with the input as signed file,
+// with the ref 7khgpu4gcfdv30w8joqxjy1cc
+func newTestAutograph(t *testing.T, auth authorization, tr testAutographResponse) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hawkAuth, err := hawk.NewAuthFromRequest(r, func(creds *hawk.Credentials) error {
+			creds.Key = auth.Key
+			creds.Hash = sha256.New
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("invalid hawk authorization: %v", err)
+		}
+		err = hawkAuth.Valid()
+		if err != nil {
+			t.Fatalf("invalid hawk authorization: %v", err)
+		}
+		if tr.status != 0 {
+			w.WriteHeader(tr.status)
+			w.Write([]byte(tr.errorBody))
+			return
+		}
+		var requests []signaturerequest
+		err = json.Unmarshal(reqBody, &requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBody, err := json.Marshal([]signatureresponse{{
+			Ref:        "7khgpu4gcfdv30w8joqxjy1cc",
+			Type:       "apk2",
+			SignerID:   requests[0].KeyID,
+			SignedFile: requests[0].Input,
+			X5U:        "https://example.com/chain.pem",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.nestedBody {
+			nested := strings.Repeat("[", 1<<20) + strings.Repeat("]", 1<<20)
+			respBody = append([]byte(`[{"extra":`+nested+`,`), respBody[2:]...)
+		}
+
+		if tr.key != "" {
+			hawkAuth.Credentials.Key = tr.key
+		}
+		if !tr.omitHash {
+			payloadHash := hawkAuth.PayloadHash("application/json")
+			payloadHash.Write(respBody)
+			hawkAuth.SetHash(payloadHash)
+		}
+		if !tr.omitAuth {
+			w.Header().Set("Server-Authorization", hawkAuth.ResponseHeader(""))
+		}
+		if tr.tamperedBody {
+			respBody = bytes.Replace(respBody, []byte(requests[0].Input), []byte(base64.StdEncoding.EncodeToString([]byte("evil"))), 1)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(respBody)
+	}))
+}
+
 func TestCallAutograph(t *testing.T) {
+	auth := conf.Authorizations[2]
+	tests := []struct {
+		name        string
+		response    testAutographResponse
+		expectedErr error
+	}{
+		{
+			name:        "authenticated response",
+			response:    testAutographResponse{},
+			expectedErr: nil,
+		},
+		{
+			name:        "missing Server-Authorization",
+			response:    testAutographResponse{omitAuth: true},
+			expectedErr: errAutographInvalidResponseAuth,
+		},
+		{
+			name:        "Server-Authorization with another key",
+			response:    testAutographResponse{key: "not the key of the authorization"},
+			expectedErr: errAutographInvalidResponseAuth,
+		},
+		{
+			name:        "Server-Authorization without payload hash",
+			response:    testAutographResponse{omitHash: true},
+			expectedErr: errAutographInvalidResponseAuth,
+		},
+		{
+			name:        "tampered response body",
+			response:    testAutographResponse{tamperedBody: true},
+			expectedErr: errAutographInvalidResponseAuth,
+		},
+		{
+			name:        "error status",
+			response:    testAutographResponse{status: http.StatusBadRequest, errorBody: "invalid input"},
+			expectedErr: errAutographBadStatusCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			autograph := newTestAutograph(t, auth, tt.response)
+			defer autograph.Close()
+
+			savedConf := conf
+			defer func() { conf = savedConf }()
+			conf.BaseURL = autograph.URL + "/"
+			conf.AutographMaxAttempts = 1
+			conf.AutographCircuitBreakerThreshold = 5
+			conf.AutographCircuitBreakerCooldown = time.Minute
+			conf.upstream = newUpstreamClient(conf)
+
+			var signed bytes.Buffer
+			_, err := callAutograph(context.Background(), auth, sectionReader([]byte("unsigned")), "127.0.0.1", &signed)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("callAutograph() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if tt.expectedErr == nil && signed.String() != "unsigned" {
+				t.Fatalf("callAutograph() = %q expected %q", signed.String(), "unsigned")
+			}
+		})
+	}
+}
+
+func TestSigHandlerNestedAutographResponse(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{nestedBody: true})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.AutographMaxAttempts = 1
+	conf.upstream = newUpstreamClient(conf)
+
+	var signed bytes.Buffer
+	_, err := callAutograph(context.Background(), auth, sectionReader([]byte("unsigned")), "127.0.0.1", &signed)
+	if err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Fatalf("callAutograph() error = %v expected a nesting error", err)
+	}
+
+	r := httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader("unsigned"))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("Authorization", auth.ClientToken)
+	w := httptest.NewRecorder()
+	sigHandler(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+}
 
+func Test_sanitizeAutographError(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"message", "failed to parse input\n", "failed to parse input"},
+		{"empty", "", ""},
+		{"control characters", "bad\x1b[31m input\r\nInjected: header\x00", "bad [31m input Injected: header"},
+		{"invalid UTF-8", "bad \xff\xfe input", "bad input"},
+		{"long message", strings.Repeat("é", maxAutographErrorMessageLength+1), strings.Repeat("é", maxAutographErrorMessageLength) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := sanitizeAutographError([]byte(tt.body))
+			if message != tt.expected {
+				t.Fatalf("sanitizeAutographError() = %q expected %q", message, tt.expected)
+			}
+		})
+	}
 }
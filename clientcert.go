@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadClientCAs returns a pool of the CA certificates in a PEM bundle
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read client CA bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %q", path)
+	}
+	return pool, nil
+}
+
+// verifiedClientCert returns the leaf certificate of the first
+// verified client certificate chain of a TLS connection, or nil
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// spkiFingerprint returns the hex encoded SHA-256 digest of the
+// certificate's DER encoded SubjectPublicKeyInfo
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func (auth authorization) hasClientCertBindings() bool {
+	return len(auth.ClientCertSubjects) > 0 || len(auth.ClientCertSPKISHA256) > 0
+}
+
+// matchesClientCert returns whether a verified client certificate has
+// one of the subjects or SPKI fingerprints the authorization is bound to
+func (auth authorization) matchesClientCert(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	subject := cert.Subject.String()
+	for _, s := range auth.ClientCertSubjects {
+		if s == subject {
+			return true
+		}
+	}
+	fingerprint := spkiFingerprint(cert)
+	for _, fp := range auth.ClientCertSPKISHA256 {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(fp)), []byte(fingerprint)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeClientCert returns the first authorization bound to the
+// verified client certificate that doesn't also require a token
+func authorizeClientCert(cert *x509.Certificate) (authorization, error) {
+	for _, auth := range conf.Authorizations {
+		if !auth.RequireClientCert && auth.matchesClientCert(cert) {
+			return auth, nil
+		}
+	}
+	return authorization{}, fmt.Errorf("%w: subject %q spki %s", errInvalidClientCert, cert.Subject.String(), spkiFingerprint(cert))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeTestCert returns a certificate and key for the subject common
+// name signed by the parent, or self-signed CA when parent is nil
+func makeTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Mozilla"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestCertFiles writes a PEM encoded certificate and key to
+// cert.pem and key.pem in dir and returns their paths
+func writeTestCertFiles(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey) (certPath, keyPath string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestAuthorizeClientCert(t *testing.T) {
+	ca, caKey := makeTestCert(t, "test CA", nil, nil)
+	bySubject, _ := makeTestCert(t, "ci-by-subject", ca, caKey)
+	bySPKI, _ := makeTestCert(t, "ci-by-spki", ca, caKey)
+	unknown, _ := makeTestCert(t, "unknown", ca, caKey)
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.Authorizations = []authorization{
+		{
+			ClientCertSubjects: []string{bySubject.Subject.String()},
+			User:               "alice",
+			Signer:             "testapp-android",
+		},
+		{
+			ClientToken:          "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			ClientCertSPKISHA256: []string{spkiFingerprint(bySPKI)},
+			RequireClientCert:    true,
+			User:                 "alice",
+			Signer:               "extensions-ecdsa",
+		},
+	}
+
+	tests := []struct {
+		name           string
+		authHeader     string
+		clientCert     *x509.Certificate
+		expectedSigner string
+		expectedErr    error
+	}{
+		{
+			name:           "client certificate without token",
+			clientCert:     bySubject,
+			expectedSigner: "testapp-android",
+		},
+		{
+			name:        "unknown client certificate without token",
+			clientCert:  unknown,
+			expectedErr: errInvalidClientCert,
+		},
+		{
+			name:        "client certificate of an auth requiring a token",
+			clientCert:  bySPKI,
+			expectedErr: errInvalidClientCert,
+		},
+		{
+			name:           "token and required client certificate",
+			authHeader:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			clientCert:     bySPKI,
+			expectedSigner: "extensions-ecdsa",
+		},
+		{
+			name:        "token without required client certificate",
+			authHeader:  "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			expectedErr: errClientCertRequired,
+		},
+		{
+			name:        "token with other client certificate",
+			authHeader:  "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			clientCert:  bySubject,
+			expectedErr: errClientCertRequired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := authorize(tt.authHeader, tt.clientCert)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("authorize() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if auth.Signer != tt.expectedSigner {
+				t.Fatalf("authorize() auth.Signer got %q expected %q", auth.Signer, tt.expectedSigner)
+			}
+		})
+	}
+}
+
+func TestPreparedServerClientCert(t *testing.T) {
+	ca, caKey := makeTestCert(t, "test CA", nil, nil)
+	known, knownKey := makeTestCert(t, "ci", ca, caKey)
+	otherCA, otherCAKey := makeTestCert(t, "other CA", nil, nil)
+	untrusted, untrustedKey := makeTestCert(t, "ci", otherCA, otherCAKey)
+	server, serverKey := makeTestCert(t, "autograph-edge", ca, caKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.TLSCert, conf.TLSKey = writeTestCertFiles(t, t.TempDir(), server, serverKey)
+	conf.TLSClientCA = caFile
+	conf.Authorizations = []authorization{
+		{
+			ClientCertSubjects: []string{known.Subject.String()},
+			User:               "alice",
+			Key:                "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:             "testapp-android",
+		},
+	}
+	err = loadTLSConfiguration(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testServer := httptest.NewUnstartedServer(nil)
+	testServer.Config = prepareServer("", 0)
+	testServer.TLS = testServer.Config.TLSConfig
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	tests := []struct {
+		name           string
+		cert           *x509.Certificate
+		key            *ecdsa.PrivateKey
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "bound client certificate is authorized",
+			cert:           known,
+			key:            knownKey,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "failed to read form data\n",
+		},
+		{
+			name:           "no client certificate",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "missing authorization header\n",
+		},
+		{
+			name:           "client certificate from an untrusted CA is not accepted",
+			cert:           untrusted,
+			key:            untrustedKey,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "missing authorization header\n",
+		},
+	}
+	baseTransport := testServer.Client().Transport.(*http.Transport)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := baseTransport.Clone()
+			if tt.cert != nil {
+				transport.TLSClientConfig.Certificates = []tls.Certificate{{
+					Certificate: [][]byte{tt.cert.Raw},
+					PrivateKey:  tt.key,
+				}}
+			}
+			client := &http.Client{Transport: transport}
+
+			res, err := client.Post(testServer.URL+"/sign", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", res.StatusCode, tt.expectedStatus)
+			}
+			if string(body) != tt.expectedBody {
+				t.Fatalf("returned unexpected body %q expected %q", body, tt.expectedBody)
+			}
+		})
+	}
+}
+
+func Test_validateTLSConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    configuration
+		wantErr bool
+	}{
+		{
+			name:    "no TLS",
+			conf:    configuration{},
+			wantErr: false,
+		},
+		{
+			name:    "TLS certificate without key",
+			conf:    configuration{TLSCert: "server.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "client CA without TLS",
+			conf:    configuration{TLSClientCA: "ca.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "missing client CA bundle",
+			conf:    configuration{TLSCert: "server.pem", TLSKey: "server.key", TLSClientCA: "/does/not/exist"},
+			wantErr: true,
+		},
+		{
+			name: "client certificate bindings without client CA",
+			conf: configuration{
+				TLSCert: "server.pem",
+				TLSKey:  "server.key",
+				Authorizations: []authorization{
+					{ClientCertSubjects: []string{"CN=ci"}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTLSConfiguration(&tt.conf)
+			if err == nil {
+				err = loadTLSConfiguration(&tt.conf)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateTLSConfiguration() and loadTLSConfiguration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
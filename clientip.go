@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerForwarded     = "Forwarded"
+)
+
+// parsePrefixes parses a list of CIDRs, or IP addresses that are
+// treated as single address CIDRs
+func parsePrefixes(cidrs []string) (prefixes []netip.Prefix, err error) {
+	for _, cidr := range cidrs {
+		var prefix netip.Prefix
+		if strings.Contains(cidr, "/") {
+			prefix, err = netip.ParsePrefix(cidr)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(cidr)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr returns whether an address is in one of the prefixes
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClientIPConfiguration parses the trusted proxies and checks
+// the header they set, which defaults to X-Forwarded-For
+func validateClientIPConfiguration(c *configuration) (err error) {
+	c.trustedProxies, err = parsePrefixes(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("error validating trusted_proxies %q", err)
+	}
+	switch http.CanonicalHeaderKey(c.ClientIPHeader) {
+	case "", headerXForwardedFor:
+		c.ClientIPHeader = headerXForwardedFor
+	case headerForwarded:
+		c.ClientIPHeader = headerForwarded
+	default:
+		return fmt.Errorf("client_ip_header must be %s or %s, not %q", headerXForwardedFor, headerForwarded, c.ClientIPHeader)
+	}
+	return nil
+}
+
+// parseNodeAddr parses the address of an X-Forwarded-For entry or of a
+// Forwarded "for" parameter, which can have a port and IPv6 addresses
+// in brackets
+func parseNodeAddr(node string) (netip.Addr, error) {
+	node = strings.TrimSpace(node)
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		addrPort, portErr := netip.ParseAddrPort(node)
+		if portErr != nil {
+			return netip.Addr{}, err
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap(), nil
+}
+
+// splitQuoted splits s on sep outside of the double quoted strings of
+// RFC 7230
+func splitQuoted(s string, sep byte) (parts []string) {
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the content of a double quoted string of RFC 7230,
+// or s if it isn't quoted
+func unquote(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, nil
+	}
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return "", fmt.Errorf("unterminated quoted string %s", s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// forwardedFor returns the "for" parameters of the elements of
+// Forwarded headers (RFC 7239), from the client to the last proxy. It
+// returns an error for elements without one.
+func forwardedFor(values []string) (nodes []string, err error) {
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var node string
+			found := false
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+				node, err = unquote(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid Forwarded element %q: %w", element, err)
+				}
+				found = true
+			}
+			if !found {
+				return nil, fmt.Errorf("invalid Forwarded element %q: missing for parameter", element)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// clientAddress is the IP of the client of a request, and the chain of
+// addresses from it through trusted proxies to the edge
+type clientAddress struct {
+	ip    netip.Addr
+	chain []netip.Addr
+	err   error
+}
+
+// String returns the chain of the client address in the format of
+// X-Forwarded-For
+func (ca clientAddress) String() string {
+	var addrs []string
+	for _, addr := range ca.chain {
+		addrs = append(addrs, addr.String())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// resolveClientAddress returns the client address of a request. When
+// the request comes from a trusted proxy, it is the right-most entry
+// of the header the proxies set that isn't a trusted proxy, since
+// entries left of it can be forged by the client.
+func resolveClientAddress(r *http.Request, trustedProxies []netip.Prefix, header string) (ca clientAddress) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ca.err = fmt.Errorf("invalid remote address %q: %w", r.RemoteAddr, err)
+		return
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		ca.err = fmt.Errorf("invalid remote address %q: %w", r.RemoteAddr, err)
+		return
+	}
+	addr = addr.Unmap()
+	ca.chain = []netip.Addr{addr}
+	if !containsAddr(trustedProxies, addr) {
+		ca.ip = addr
+		return
+	}
+
+	var nodes []string
+	if header == headerForwarded {
+		nodes, err = forwardedFor(r.Header.Values(headerForwarded))
+		if err != nil {
+			ca.err = err
+			return
+		}
+	} else {
+		for _, value := range r.Header.Values(headerXForwardedFor) {
+			nodes = append(nodes, strings.Split(value, ",")...)
+		}
+	}
+	for i := len(nodes) - 1; i >= 0 && containsAddr(trustedProxies, addr); i-- {
+		addr, err = parseNodeAddr(nodes[i])
+		if err != nil {
+			ca.err = fmt.Errorf("invalid %s address %q: %w", header, nodes[i], err)
+			return
+		}
+		ca.chain = append([]netip.Addr{addr}, ca.chain...)
+	}
+	ca.ip = addr
+	return
+}
+
+// setClientAddress is a middleware that resolves the client address of
+// requests and adds it to their context
+func setClientAddress() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ca := resolveClientAddress(r, conf.trustedProxies, conf.ClientIPHeader)
+			h.ServeHTTP(w, addToContext(r, contextKeyClientAddress, ca))
+		})
+	}
+}
+
+// getClientAddress returns the client address of a request from its
+// context, or resolves it if it isn't there
+func getClientAddress(r *http.Request) clientAddress {
+	ca, ok := r.Context().Value(contextKeyClientAddress).(clientAddress)
+	if ok {
+		return ca
+	}
+	return resolveClientAddress(r, conf.trustedProxies, conf.ClientIPHeader)
+}
+
+// allowClientIP checks that the client of a request is in the allowed
+// CIDRs of its authorization, if it has some, and otherwise audits the
+// request and responds with a 403
+func allowClientIP(w http.ResponseWriter, r *http.Request, auth authorization) bool {
+	if len(auth.allowedPrefixes) == 0 {
+		return true
+	}
+	ca := getClientAddress(r)
+	if ca.err == nil && containsAddr(auth.allowedPrefixes, ca.ip) {
+		return true
+	}
+	rec := newAuditRecord(r, auth, auditEventClientIPDenied)
+	rec.Error = errClientIPNotAllowed.Error()
+	if ca.err != nil {
+		rec.Error = ca.err.Error()
+	}
+	audit(rec)
+	httpError(w, r, http.StatusForbidden, codeClientIPNotAllowed, "%s", errClientIPNotAllowed)
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func Test_parsePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    []string
+		expected []netip.Prefix
+		wantErr  bool
+	}{
+		{"none", nil, nil, false},
+		{"CIDRs", []string{"10.0.0.0/8", "2001:db8::/32"}, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}, false},
+		{"addresses", []string{"192.0.2.1", "2001:db8::1"}, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("2001:db8::1/128")}, false},
+		{"host bits are masked", []string{"192.0.2.1/24"}, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, false},
+		{"invalid CIDR", []string{"192.0.2.0/33"}, nil, true},
+		{"invalid address", []string{"example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := parsePrefixes(tt.cidrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrefixes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(prefixes) != len(tt.expected) {
+				t.Fatalf("parsePrefixes() = %v expected %v", prefixes, tt.expected)
+			}
+			for i := range prefixes {
+				if prefixes[i] != tt.expected[i] {
+					t.Fatalf("parsePrefixes() = %v expected %v", prefixes, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_resolveClientAddress(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		header        string
+		values        []string
+		trusted       []netip.Prefix
+		expectedChain string
+		wantErr       bool
+	}{
+		{"remote address", "192.0.2.1:1234", headerXForwardedFor, nil, trusted, "192.0.2.1", false},
+		{"IPv6 remote address", "[2001:db8::1]:1234", headerXForwardedFor, nil, trusted, "2001:db8::1", false},
+		{"IPv4-mapped remote address", "[::ffff:192.0.2.1]:1234", headerXForwardedFor, nil, trusted, "192.0.2.1", false},
+		{"forwarded by an untrusted proxy", "192.0.2.1:1234", headerXForwardedFor, []string{"198.51.100.1"}, trusted, "192.0.2.1", false},
+		{"no trusted proxies", "10.0.0.1:1234", headerXForwardedFor, []string{"198.51.100.1"}, nil, "10.0.0.1", false},
+		{"forwarded by a trusted proxy", "10.0.0.1:1234", headerXForwardedFor, []string{"198.51.100.1"}, trusted, "198.51.100.1, 10.0.0.1", false},
+		{"forged entries are skipped", "10.0.0.1:1234", headerXForwardedFor, []string{"203.0.113.1, 198.51.100.1, 10.1.1.1"}, trusted, "198.51.100.1, 10.1.1.1, 10.0.0.1", false},
+		{"multiple headers", "[fd00::1]:1234", headerXForwardedFor, []string{"203.0.113.1", "198.51.100.1, fd00::2"}, trusted, "198.51.100.1, fd00::2, fd00::1", false},
+		{"entries with ports", "10.0.0.1:1234", headerXForwardedFor, []string{"198.51.100.1:4711, [fd00::2]:80"}, trusted, "198.51.100.1, fd00::2, 10.0.0.1", false},
+		{"only trusted proxies", "10.0.0.1:1234", headerXForwardedFor, []string{"10.0.0.3, 10.0.0.2"}, trusted, "10.0.0.3, 10.0.0.2, 10.0.0.1", false},
+		{"no X-Forwarded-For", "10.0.0.1:1234", headerXForwardedFor, nil, trusted, "10.0.0.1", false},
+		{"invalid forwarded address", "10.0.0.1:1234", headerXForwardedFor, []string{"198.51.100.1, unknown"}, trusted, "", true},
+		{"invalid remote address", "192.0.2.1", headerXForwardedFor, nil, trusted, "", true},
+		{"Forwarded", "10.0.0.1:1234", headerForwarded, []string{`for=203.0.113.1, For="[2001:db8:cafe::17]:4711";proto=https, for=10.1.1.1;by=10.0.0.1`}, trusted, "2001:db8:cafe::17, 10.1.1.1, 10.0.0.1", false},
+		{"Forwarded ignores X-Forwarded-For", "10.0.0.1:1234", headerForwarded, nil, trusted, "10.0.0.1", false},
+		{"Forwarded from an untrusted proxy", "192.0.2.1:1234", headerForwarded, []string{"for=198.51.100.1"}, trusted, "192.0.2.1", false},
+		{"obfuscated Forwarded identifier", "10.0.0.1:1234", headerForwarded, []string{"for=_hidden"}, trusted, "", true},
+		{"Forwarded element without for", "10.0.0.1:1234", headerForwarded, []string{"for=198.51.100.1, proto=https"}, trusted, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.values {
+				r.Header.Add(tt.header, value)
+			}
+			if tt.header == headerForwarded {
+				r.Header.Set(headerXForwardedFor, "198.51.100.2")
+			}
+			ca := resolveClientAddress(r, tt.trusted, tt.header)
+			if (ca.err != nil) != tt.wantErr {
+				t.Fatalf("resolveClientAddress() error = %v, wantErr %v", ca.err, tt.wantErr)
+			}
+			if ca.err != nil {
+				return
+			}
+			if ca.String() != tt.expectedChain {
+				t.Fatalf("resolveClientAddress() chain = %q expected %q", ca.String(), tt.expectedChain)
+			}
+			if ca.ip != ca.chain[0] {
+				t.Fatalf("resolveClientAddress() IP = %s expected the first address of the chain", ca.ip)
+			}
+		})
+	}
+}
+
+func Test_forwardedFor(t *testing.T) {
+	nodes, err := forwardedFor([]string{
+		`for=192.0.2.43, for="[2001:db8:cafe::17]"`,
+		`proto=http;for="198.51.100.17:80\\";by=203.0.113.60, FOR=unknown;host="a,b;c"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.0.2.43", "[2001:db8:cafe::17]", "198.51.100.17:80\\", "unknown"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("forwardedFor() = %q expected %q", nodes, expected)
+	}
+	for i := range nodes {
+		if nodes[i] != expected[i] {
+			t.Fatalf("forwardedFor() = %q expected %q", nodes, expected)
+		}
+	}
+	_, err = forwardedFor([]string{`for="192.0.2.43`})
+	if err == nil {
+		t.Fatal("forwardedFor() of an unterminated quoted string expected an error")
+	}
+}
+
+func Test_validateClientIPConfiguration(t *testing.T) {
+	tests := []struct {
+		name           string
+		conf           configuration
+		expectedHeader string
+		wantErr        bool
+	}{
+		{"defaults", configuration{}, headerXForwardedFor, false},
+		{"Forwarded", configuration{TrustedProxies: []string{"10.0.0.0/8"}, ClientIPHeader: "forwarded"}, headerForwarded, false},
+		{"X-Forwarded-For", configuration{ClientIPHeader: "x-forwarded-for"}, headerXForwardedFor, false},
+		{"other header", configuration{ClientIPHeader: "X-Real-IP"}, "", true},
+		{"invalid trusted proxy", configuration{TrustedProxies: []string{"10.0.0.0/33"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClientIPConfiguration(&tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateClientIPConfiguration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.conf.ClientIPHeader != tt.expectedHeader {
+				t.Fatalf("validateClientIPConfiguration() header = %q expected %q", tt.conf.ClientIPHeader, tt.expectedHeader)
+			}
+		})
+	}
+}
+
+func TestSigHandlerAllowedCIDRs(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+	conf.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	conf.Authorizations = append([]authorization{}, savedConf.Authorizations...)
+	conf.Authorizations[2].allowedPrefixes = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		xff          string
+		expectedCode int
+	}{
+		{"allowed", "192.0.2.1:1234", "", http.StatusCreated},
+		{"denied", "198.51.100.1:1234", "", http.StatusForbidden},
+		{"allowed behind a trusted proxy", "10.0.0.1:1234", "192.0.2.1", http.StatusCreated},
+		{"denied behind a trusted proxy", "10.0.0.1:1234", "192.0.2.1, 198.51.100.1", http.StatusForbidden},
+		{"forged X-Forwarded-For", "198.51.100.1:1234", "192.0.2.1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("input", "app.apk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("unsigned"))
+			mw.Close()
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("Authorization", auth.ClientToken)
+			w := httptest.NewRecorder()
+			sigHandler(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+		})
+	}
+}
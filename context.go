@@ -14,6 +14,10 @@ func (k *contextKey) String() string { return "github.com/mozilla-services/autog
 var (
 	// ctxReqID is the string identifier of a request ID in a context
 	contextKeyRequestID = contextKey{name: "reqID"}
+
+	// contextKeyClientAddress is the clientAddress of a request in a
+	// context
+	contextKeyClientAddress = contextKey{name: "clientAddress"}
 )
 
 // addToContext add the given key value pair to the given request's context
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// coseSignTag is the CBOR tag of a COSE_Sign message
+	coseSignTag = 98
+
+	// coseHeaderAlg and coseHeaderKid are the COSE header labels of
+	// the signature algorithm and key identifier
+	coseHeaderAlg = 1
+	coseHeaderKid = 4
+)
+
+// coseAlgorithm is a COSE signature algorithm supported for add-ons
+type coseAlgorithm struct {
+	name string
+	hash crypto.Hash
+}
+
+// coseAlgorithms are the COSE algorithms add-ons can be signed with,
+// by IANA identifier
+var coseAlgorithms = map[int64]coseAlgorithm{
+	-7:  {"ES256", crypto.SHA256},
+	-35: {"ES384", crypto.SHA384},
+	-36: {"ES512", crypto.SHA512},
+	-37: {"PS256", crypto.SHA256},
+}
+
+// coseSignMessage is a COSE_Sign message with a detached payload
+type coseSignMessage struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Payload     []byte
+	Signatures  []coseSignature
+}
+
+type coseSignature struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Signature   []byte
+}
+
+// coseSigner is a verified signature of a COSE_Sign message
+type coseSigner struct {
+	algorithm string
+	cert      *x509.Certificate
+}
+
+// verifyCOSESignatures verifies the signatures of a COSE_Sign message
+// over the detached payload, as used to sign add-ons: the body
+// protected header holds the intermediate certificates, and each
+// signature's protected header its algorithm and end-entity
+// certificate, which must chain to one of the roots. It returns the
+// signers when all signatures are valid.
+func verifyCOSESignatures(message, payload []byte, roots *x509.CertPool) (signers []coseSigner, err error) {
+	var tag cbor.RawTag
+	err = cbor.Unmarshal(message, &tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode COSE message: %v", err)
+	}
+	if tag.Number != coseSignTag {
+		return nil, fmt.Errorf("COSE message has tag %d expected %d", tag.Number, coseSignTag)
+	}
+	var msg coseSignMessage
+	err = cbor.Unmarshal(tag.Content, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode COSE_Sign message: %v", err)
+	}
+	if msg.Payload != nil {
+		return nil, fmt.Errorf("COSE_Sign message payload is not detached")
+	}
+	if len(msg.Signatures) == 0 {
+		return nil, fmt.Errorf("COSE_Sign message has no signatures")
+	}
+
+	var bodyHeader struct {
+		Kid [][]byte `cbor:"4,keyasint"`
+	}
+	err = cbor.Unmarshal(msg.Protected, &bodyHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode COSE_Sign protected header: %v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range bodyHeader.Kid {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse COSE intermediate certificate: %v", err)
+		}
+		intermediates.AddCert(cert)
+	}
+
+	for i, sig := range msg.Signatures {
+		var header struct {
+			Alg int64  `cbor:"1,keyasint"`
+			Kid []byte `cbor:"4,keyasint"`
+		}
+		err = cbor.Unmarshal(sig.Protected, &header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode protected header of COSE signature %d: %v", i, err)
+		}
+		alg, supported := coseAlgorithms[header.Alg]
+		if !supported {
+			return nil, fmt.Errorf("COSE signature %d uses unsupported algorithm %d", i, header.Alg)
+		}
+		cert, err := x509.ParseCertificate(header.Kid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate of COSE signature %d: %v", i, err)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify certificate chain of COSE signature %d: %v", i, err)
+		}
+		toBeSigned, err := cbor.Marshal([]interface{}{"Signature", msg.Protected, sig.Protected, []byte{}, payload})
+		if err != nil {
+			return nil, err
+		}
+		err = verifyCOSESignature(alg, cert.PublicKey, toBeSigned, sig.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s COSE signature %d: %v", alg.name, i, err)
+		}
+		signers = append(signers, coseSigner{algorithm: alg.name, cert: cert})
+	}
+	return signers, nil
+}
+
+// verifyCOSESignature checks an ECDSA signature, encoded as the
+// concatenation of r and s, or an RSASSA-PSS signature
+func verifyCOSESignature(alg coseAlgorithm, publicKey interface{}, toBeSigned, signature []byte) error {
+	h := alg.hash.New()
+	h.Write(toBeSigned)
+	digest := h.Sum(nil)
+	switch pub := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if alg.name[:2] != "ES" {
+			return fmt.Errorf("ECDSA key for %s signature", alg.name)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature is %d bytes long want %d", len(signature), 2*size)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("signature does not match")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg.name[:2] != "PS" {
+			return fmt.Errorf("RSA key for %s signature", alg.name)
+		}
+		return rsa.VerifyPSS(pub, alg.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// the codes of error responses, which are stable unlike their messages
+// so clients can tell errors apart
+const (
+	codeNotFound                  = "not_found"
+	codeInvalidMethod             = "invalid_method"
+	codeMissingAuthorization      = "missing_authorization"
+	codeUnauthorized              = "unauthorized"
+	codeTokenExpired              = "token_expired"
+	codeTokenNotYetValid          = "token_not_yet_valid"
+	codeClientCertRequired        = "client_cert_required"
+	codeClientIPNotAllowed        = "client_ip_not_allowed"
+	codeRateLimited               = "rate_limited"
+	codeTooManyConcurrentSignings = "too_many_concurrent_signings"
+	codeAtCapacity                = "at_capacity"
+	codeQuotaExceeded             = "quota_exceeded"
+	codeBodyTooLarge              = "body_too_large"
+	codeInputTooLarge             = "input_too_large"
+	codeInvalidRequest            = "invalid_request"
+	codeMissingInput              = "missing_input"
+	codeInvalidXPI                = "invalid_xpi"
+	codeXPIMissingManifest        = "xpi_missing_manifest"
+	codeXPIAddonIDMismatch        = "xpi_addon_id_mismatch"
+	codeInvalidAPK                = "invalid_apk"
+	codeAPKMissingManifest        = "apk_missing_manifest"
+	codeAPKPackageMismatch        = "apk_package_mismatch"
+	codeAPKVersionCodeTooLow      = "apk_version_code_too_low"
+	codeAutographUnavailable      = "autograph_unavailable"
+	codeAutographError            = "autograph_error"
+	codeAutographRejectedInput    = "autograph_rejected_input"
+	codeAutographUnauthorized     = "autograph_unauthorized"
+	codeAutographRequestRejected  = "autograph_request_rejected"
+	codeAutographInvalidResponse  = "autograph_invalid_response"
+	codeSignatureVerification     = "signature_verification_failed"
+	codeShuttingDown              = "shutting_down"
+	codeInternalError             = "internal_error"
+)
+
+// retryableCodes are the codes of errors that can go away when the
+// request is retried later
+var retryableCodes = map[string]bool{
+	codeRateLimited:               true,
+	codeTooManyConcurrentSignings: true,
+	codeAtCapacity:                true,
+	codeAutographUnavailable:      true,
+	codeAutographError:            true,
+	codeShuttingDown:              true,
+}
+
+// errorCodes are the codes of the errors responses can be about
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errInvalidToken, codeUnauthorized},
+	{errTokenExpired, codeTokenExpired},
+	{errTokenNotYetValid, codeTokenNotYetValid},
+	{errInvalidOIDCToken, codeUnauthorized},
+	{errNoOIDCAuthorization, codeUnauthorized},
+	{errInvalidClientCert, codeUnauthorized},
+	{errClientCertRequired, codeClientCertRequired},
+	{errClientIPNotAllowed, codeClientIPNotAllowed},
+	{errMissingInput, codeMissingInput},
+	{errBodyTooLarge, codeBodyTooLarge},
+	{errInputTooLarge, codeInputTooLarge},
+	{errRateLimited, codeRateLimited},
+	{errTooManyConcurrentSignings, codeTooManyConcurrentSignings},
+	{errAtCapacity, codeAtCapacity},
+	{errQuotaExceeded, codeQuotaExceeded},
+	{errAutographBadStatusCode, codeAutographError},
+	{errAutographBadResponseCount, codeAutographInvalidResponse},
+	{errAutographEmptyResponse, codeAutographInvalidResponse},
+	{errAutographCircuitOpen, codeAutographUnavailable},
+	{errAutographInvalidResponseAuth, codeAutographInvalidResponse},
+	{errSignatureVerification, codeSignatureVerification},
+	{errXPIInvalid, codeInvalidXPI},
+	{errXPIMissingManifest, codeXPIMissingManifest},
+	{errXPIAddonIDMismatch, codeXPIAddonIDMismatch},
+	{errAPKInvalid, codeInvalidAPK},
+	{errAPKMissingManifest, codeAPKMissingManifest},
+	{errAPKPackageMismatch, codeAPKPackageMismatch},
+	{errAPKVersionCodeTooLow, codeAPKVersionCodeTooLow},
+}
+
+// codeOf returns the code of the first error of errorCodes that err
+// wraps, or fallback
+func codeOf(err error, fallback string) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return fallback
+}
+
+// errorResponse is the body of error responses to clients that send or
+// accept JSON
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	Retryable bool   `json:"retryable"`
+}
+
+// wantsJSON returns whether a request has a JSON body or accepts a JSON
+// response
+func wantsJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == mediaTypeJSON || acceptsJSON(r)
+}
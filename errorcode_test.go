@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_codeOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"sentinel", errAutographCircuitOpen, codeAutographUnavailable},
+		{"wrapped", fmt.Errorf("%w: found %q expected %q", errXPIAddonIDMismatch, "a", "b"), codeXPIAddonIDMismatch},
+		{"unknown", fmt.Errorf("connection refused"), codeInternalError},
+		{"nil", nil, codeInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := codeOf(tt.err, codeInternalError)
+			if code != tt.expected {
+				t.Fatalf("codeOf() = %q expected %q", code, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		accept        string
+		code          string
+		expectedJSON  bool
+		expectedRetry bool
+	}{
+		{"plain text", "", "", codeInvalidMethod, false, false},
+		{"accepts JSON", "", "application/json", codeAtCapacity, true, true},
+		{"JSON request", "application/json", "", codeXPIAddonIDMismatch, true, false},
+		{"form data accepting text", "multipart/form-data; boundary=x", "text/plain", codeRateLimited, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Accept", tt.accept)
+			r = addToContext(r, contextKeyRequestID, "rid")
+			w := httptest.NewRecorder()
+			httpError(w, r, http.StatusServiceUnavailable, tt.code, "failed: %s", "oops")
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("httpError returned %d expected %d", w.Code, http.StatusServiceUnavailable)
+			}
+			if !tt.expectedJSON {
+				if w.Body.String() != "failed: oops\n" {
+					t.Fatalf("httpError returned %q expected %q", w.Body.String(), "failed: oops\n")
+				}
+				return
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("httpError returned content type %q expected application/json", w.Header().Get("Content-Type"))
+			}
+			var response errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := errorResponse{Code: tt.code, Message: "failed: oops", RequestID: "rid", Retryable: tt.expectedRetry}
+			if response != expected {
+				t.Fatalf("httpError returned %+v expected %+v", response, expected)
+			}
+		})
+	}
+}
+
+func TestSigHandlerErrorCodes(t *testing.T) {
+	auth := conf.Authorizations[2]
+	failingAutograph := newTestAutograph(t, auth, testAutographResponse{tamperedBody: true})
+	defer failingAutograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = failingAutograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+
+	tests := []struct {
+		name         string
+		method       string
+		token        string
+		expectedCode int
+		expected     string
+	}{
+		{"invalid method", "GET", auth.ClientToken, http.StatusMethodNotAllowed, codeInvalidMethod},
+		{"missing authorization", "POST", "", http.StatusUnauthorized, codeMissingAuthorization},
+		{"invalid autograph response", "POST", auth.ClientToken, http.StatusBadGateway, codeAutographInvalidResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://localhost:8080/sign", strings.NewReader("unsigned"))
+			r.Header.Set("Content-Type", "application/octet-stream")
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("Authorization", tt.token)
+			w := httptest.NewRecorder()
+			handleWithMiddleware(http.HandlerFunc(sigHandler), setRequestID()).ServeHTTP(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			var response errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.expected || response.RequestID == "-" {
+				t.Fatalf("sigHandler returned %+v expected code %s and a request ID", response, tt.expected)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,8 +19,13 @@ import (
 // signed file. The Authorization header of the http request must contain a valid token.
 func sigHandler(w http.ResponseWriter, r *http.Request) {
 	rid := getRequestID(r)
+	clientAddr := getClientAddress(r)
+	if clientAddr.err != nil {
+		log.WithFields(log.Fields{"rid": rid}).Warnf("failed to resolve client IP: %s", clientAddr.err)
+	}
 	log.WithFields(log.Fields{
-		"remoteAddressChain": "[" + r.Header.Get("X-Forwarded-For") + "]",
+		"remoteAddressChain": "[" + clientAddr.String() + "]",
+		"client_ip":          clientAddr.ip.String(),
 		"method":             r.Method,
 		"proto":              r.Proto,
 		"url":                r.URL.String(),
@@ -28,68 +36,278 @@ func sigHandler(w http.ResponseWriter, r *http.Request) {
 	// some sanity checking on the request
 	if r.Method != http.MethodPost {
 		log.WithFields(log.Fields{"rid": rid}).Error("invalid method")
-		httpError(w, r, http.StatusMethodNotAllowed, "invalid method")
+		httpError(w, r, http.StatusMethodNotAllowed, codeInvalidMethod, "invalid method")
 		return
 	}
-	if len(r.Header.Get("Authorization")) < 60 {
-		log.WithFields(log.Fields{"rid": rid}).Error("missing authorization header")
-		httpError(w, r, http.StatusUnauthorized, "missing authorization header")
+	auth, ok := authorizeRequest(w, r)
+	if !ok {
 		return
 	}
-	// verify auth token
-	auth, err := authorize(r.Header.Get("Authorization"))
+	setSignMetricLabels(r, auth)
+	if !allowClientIP(w, r, auth) {
+		return
+	}
+
+	release, retryAfter, err := signingLimits.acquire(auth, conf.MaxConcurrentSignings, time.Now())
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusUnauthorized, "not authorized")
+		log.WithFields(log.Fields{"rid": rid, "user": auth.User, "signer": auth.Signer, "client_ip": clientAddr.ip.String()}).Error(err)
+		limitedSignRequests.WithLabelValues(auth.User, auth.Signer, limitLabel(err)).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		if err == errAtCapacity {
+			httpError(w, r, http.StatusServiceUnavailable, codeOf(err, codeAtCapacity), "%s", err)
+		} else {
+			httpError(w, r, http.StatusTooManyRequests, codeOf(err, codeRateLimited), "%s", err)
+		}
 		return
 	}
+	defer release()
 
-	fd, fdHeader, err := r.FormFile("input")
+	// count the signing against the quotas of the authorization, and
+	// give it back unless the signed file is returned
+	refund, retryAfter, err := conf.quotas.reserve(auth, time.Now())
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusBadRequest, "failed to read form data")
+		log.WithFields(log.Fields{"rid": rid, "user": auth.User, "signer": auth.Signer, "client_ip": clientAddr.ip.String()}).Error(err)
+		if !errors.Is(err, errQuotaExceeded) {
+			httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to check signing quota")
+			return
+		}
+		limitedSignRequests.WithLabelValues(auth.User, auth.Signer, limitLabel(err)).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		httpError(w, r, http.StatusTooManyRequests, codeQuotaExceeded, "%s", err)
 		return
 	}
-	defer fd.Close()
+	signed := false
+	defer func() {
+		if !signed {
+			refund()
+		}
+	}()
 
-	input := make([]byte, fdHeader.Size)
-	_, err = io.ReadFull(fd, input)
+	// spool the input to a temporary file instead of holding it in
+	// memory, so large APKs can be signed
+	inputFile, err := newSpooledFile(conf.TempDir)
+	if err != nil {
+		log.WithFields(log.Fields{"rid": rid}).Error(err)
+		httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to store input")
+		return
+	}
+	defer inputFile.Close()
+	var inputWriter io.Writer = inputFile
+	limited := &maxSizeWriter{w: inputFile, max: auth.MaxInputBytes}
+	if auth.MaxInputBytes > 0 {
+		inputWriter = limited
+	}
+	mediaType, err := readSignInput(r, inputWriter)
 	if err != nil {
+		switch {
+		case isBodyTooLarge(err):
+			rejectBodyTooLarge(w, r, conf.MaxBodyBytes)
+			return
+		case errors.Is(err, errInputTooLarge):
+			log.WithFields(log.Fields{
+				"rid":              rid,
+				"user":             auth.User,
+				"signer":           auth.Signer,
+				"input_bytes_read": limited.read,
+				"max_input_bytes":  auth.MaxInputBytes,
+			}).Error(errInputTooLarge)
+			httpError(w, r, http.StatusRequestEntityTooLarge, codeInputTooLarge, "%s: the maximum is %d bytes", errInputTooLarge, auth.MaxInputBytes)
+			return
+		}
 		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusBadRequest, "failed to read input")
+		switch mediaType {
+		case mediaTypeJSON:
+			httpError(w, r, http.StatusBadRequest, codeOf(err, codeInvalidRequest), "failed to decode JSON request: %s", err)
+		case mediaTypeOctetStream:
+			httpError(w, r, http.StatusBadRequest, codeInvalidRequest, "failed to read input")
+		default:
+			httpError(w, r, http.StatusBadRequest, codeOf(err, codeInvalidRequest), "failed to read form data")
+		}
 		return
 	}
-	inputSha256 := fmt.Sprintf("%x", sha256.Sum256(input))
+	input := inputFile.reader()
+	inputSha256 := inputFile.sha256()
+	signInputBytes.WithLabelValues(auth.User, auth.Signer).Observe(float64(input.Size()))
 
-	// prepare an x-forwarded-for by reusing the values received and adding the client IP
-	clientip := strings.Split(r.RemoteAddr, ":")
-	xff := strings.Join([]string{
-		r.Header.Get("X-Forwarded-For"),
-		strings.Join(clientip[:len(clientip)-1], ":")},
-		",")
+	// refuse to sign add-ons that declare an ID other than the
+	// authorized one, autograph would reject them anyway
+	if auth.AddonID != "" {
+		err = validateXPIAddonID(input, auth.AddonID)
+		if err != nil {
+			log.WithFields(log.Fields{"rid": rid, "input_sha256": inputSha256}).Error(err)
+			httpError(w, r, http.StatusBadRequest, codeOf(err, codeInvalidRequest), "%s", err)
+			return
+		}
+	}
+	// likewise, check APKs against the package policy if there is one
+	if auth.APKPackageName != "" || auth.APKMinVersionCode > 0 {
+		err = validateAPKManifest(input, auth)
+		if err != nil {
+			log.WithFields(log.Fields{"rid": rid, "input_sha256": inputSha256}).Error(err)
+			httpError(w, r, http.StatusBadRequest, codeOf(err, codeInvalidRequest), "%s", err)
+			return
+		}
+	}
+
+	// forward the addresses of the client and the trusted proxies in
+	// between, without the entries the client could have forged
+	xff := clientAddr.String()
 
 	// let's get this file signed!
-	output, err := callAutograph(auth, input, xff)
+	outputFile, err := newSpooledFile(conf.TempDir)
+	if err != nil {
+		log.WithFields(log.Fields{"rid": rid}).Error(err)
+		httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to store signed file")
+		return
+	}
+	defer outputFile.Close()
+	record := newAuditRecord(r, auth, auditEventSign)
+	record.InputSHA256 = inputSha256
+	response, err := callAutograph(r.Context(), auth, input, xff, outputFile)
+	if err != nil {
+		fields := log.Fields{"rid": rid, "input_sha256": inputSha256}
+		var statusErr *autographStatusError
+		if errors.As(err, &statusErr) {
+			fields["upstream_status"] = statusErr.StatusCode
+		}
+		log.WithFields(fields).Error(err)
+		record.Event, record.Error = auditEventSignFailed, err.Error()
+		audit(record)
+		if statusErr != nil {
+			status, code, msg := statusErr.clientError()
+			httpError(w, r, status, code, "%s", msg)
+			return
+		}
+		httpError(w, r, http.StatusBadGateway, codeOf(err, codeAutographUnavailable), "failed to call autograph for signature")
+		return
+	}
+	output := outputFile.reader()
+	record.OutputSHA256 = outputFile.sha256()
+	record.Ref = response.Ref
+	if conf.VerifySignatures {
+		err = verifySignedFile(auth, input, output, conf.addonRoots)
+		if err != nil {
+			log.WithFields(log.Fields{"rid": rid, "input_sha256": inputSha256}).Error(err)
+			signatureVerificationFailures.WithLabelValues(auth.User, auth.Signer).Inc()
+			record.Event, record.Error = auditEventSignFailed, err.Error()
+			audit(record)
+			httpError(w, r, http.StatusBadGateway, codeSignatureVerification, "%s", errSignatureVerification)
+			return
+		}
+	}
+	// signed files that can't be audited aren't returned
+	err = audit(record)
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid, "input_sha256": inputSha256}).Error(err)
-		httpError(w, r, http.StatusBadGateway, "failed to call autograph for signature")
+		httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to audit signing")
 		return
 	}
-	outputSha256 := fmt.Sprintf("%x", sha256.Sum256(output))
 
 	log.WithFields(log.Fields{"rid": rid,
 		"user":          auth.User,
 		"input_sha256":  inputSha256,
-		"output_sha256": outputSha256,
+		"output_sha256": outputFile.sha256(),
 	}).Info("returning signed data")
 
-	w.Header().Add("Content-Type", "application/octet-stream")
+	// clients that send or accept JSON get the signed file base64
+	// encoded in a JSON object with its metadata
+	contentType := mediaTypeOctetStream
+	var body io.Reader = output
+	length := output.Size()
+	if wantsJSON(r) {
+		contentType = mediaTypeJSON
+		body, length, err = signResponseBody(response, record.OutputSHA256, output)
+		if err != nil {
+			log.WithFields(log.Fields{"rid": rid}).Error(err)
+			httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to encode signed file")
+			return
+		}
+	}
+
+	signed = true
+	setSignatureHeaders(w.Header(), response, record.OutputSHA256)
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
 	w.WriteHeader(http.StatusCreated)
-	w.Write(output)
+	io.Copy(w, body)
+}
+
+// signResponse is the body of the /sign responses to clients that
+// send or accept JSON
+type signResponse struct {
+	SignedFile   string `json:"signed_file"`
+	Ref          string `json:"ref"`
+	Type         string `json:"type"`
+	SignerID     string `json:"signer_id"`
+	X5U          string `json:"x5u,omitempty"`
+	OutputSHA256 string `json:"output_sha256"`
+}
+
+// signResponseBody returns a reader of the signResponse of a signed
+// file, base64 encoding it as the body is read, and the length of the
+// body
+func signResponseBody(response signatureresponse, outputSHA256 string, output *io.SectionReader) (body io.Reader, length int64, err error) {
+	marshaled, err := json.Marshal(signResponse{
+		Ref:          response.Ref,
+		Type:         response.Type,
+		SignerID:     response.SignerID,
+		X5U:          response.X5U,
+		OutputSHA256: outputSHA256,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	newBody, length, err := base64FieldBody(marshaled, "signed_file", output)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newBody(), length, nil
+}
+
+// setSignatureHeaders adds the metadata of the signature autograph
+// returned and the SHA-256 of the signed file to the response headers,
+// so clients can record where it comes from
+func setSignatureHeaders(h http.Header, response signatureresponse, outputSHA256 string) {
+	for name, value := range map[string]string{
+		"X-Autograph-Ref":           response.Ref,
+		"X-Autograph-Type":          response.Type,
+		"X-Autograph-Signer-ID":     response.SignerID,
+		"X-Autograph-X5U":           response.X5U,
+		"X-Autograph-Output-SHA256": outputSHA256,
+	} {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+}
+
+// authorizeRequest returns the authorization of a request, which can
+// authenticate with a verified client certificate instead of an
+// Authorization header, or responds with a 401 and returns false
+func authorizeRequest(w http.ResponseWriter, r *http.Request) (auth authorization, ok bool) {
+	rid := getRequestID(r)
+	clientCert := verifiedClientCert(r.TLS)
+	if clientCert == nil && len(r.Header.Get("Authorization")) < 60 {
+		log.WithFields(log.Fields{"rid": rid}).Error("missing authorization header")
+		httpError(w, r, http.StatusUnauthorized, codeMissingAuthorization, "missing authorization header")
+		return authorization{}, false
+	}
+	// verify auth token
+	auth, err := authorize(r.Header.Get("Authorization"), clientCert)
+	if err != nil {
+		log.WithFields(log.Fields{"rid": rid}).Error(err)
+		switch err {
+		case errTokenExpired, errTokenNotYetValid, errClientCertRequired:
+			httpError(w, r, http.StatusUnauthorized, codeOf(err, codeUnauthorized), "not authorized: %s", err)
+		default:
+			httpError(w, r, http.StatusUnauthorized, codeUnauthorized, "not authorized")
+		}
+		return authorization{}, false
+	}
+	return auth, true
 }
 
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	httpError(w, r, http.StatusNotFound, "404 page not found")
+	httpError(w, r, http.StatusNotFound, codeNotFound, "404 page not found")
 	return
 }
 
@@ -104,10 +322,27 @@ type heartbeat struct {
 	Checks struct {
 		CheckAutographHeartbeat bool `json:"check_autograph_heartbeat"`
 	} `json:"checks"`
-	Details string `json:"details"`
+	Details   string              `json:"details"`
+	Upstreams []upstreamHeartbeat `json:"upstreams"`
+	// ExpiringClientTokens is the number of client tokens expiring
+	// within the warning window, which are identified in the logs
+	ExpiringClientTokens int `json:"expiring_client_tokens,omitempty"`
+}
+
+// upstreamHeartbeat is the health and circuit breaker state of an
+// autograph upstream
+type upstreamHeartbeat struct {
+	URL            string `json:"url"`
+	Healthy        bool   `json:"healthy"`
+	CircuitBreaker string `json:"circuit_breaker"`
 }
 
 func writeHeartbeatResponse(w http.ResponseWriter, st heartbeat) {
+	if st.Status {
+		heartbeatChecks.WithLabelValues("ok").Inc()
+	} else {
+		heartbeatChecks.WithLabelValues("failed").Inc()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if !st.Status {
 		log.Println(st.Details)
@@ -122,33 +357,55 @@ func writeHeartbeatResponse(w http.ResponseWriter, st heartbeat) {
 	w.Write(jsonSt)
 }
 
-// send a GET request to the autograph heartbeat endpoint and
-// evaluate its status code before responding
-func heartbeatHandler(baseURL string, client heartbeatRequester) http.HandlerFunc {
-	var (
-		st           heartbeat
-		heartbeatURL string = baseURL + "__heartbeat__"
-	)
+// probeHeartbeat sends a GET request to the heartbeat endpoint of the
+// autograph at baseURL and returns an error unless it returns a 200
+func probeHeartbeat(client heartbeatRequester, baseURL string) error {
+	heartbeatURL := baseURL + "__heartbeat__"
+	resp, err := client.Get(heartbeatURL)
+	if err != nil {
+		return fmt.Errorf("failed to request autograph heartbeat from %s: %v", heartbeatURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream autograph returned heartbeat code %d %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// send a GET request to the heartbeat endpoint of every autograph
+// upstream and evaluate their status codes before responding. The edge
+// is healthy when at least one upstream is. Client tokens about to
+// expire are counted and logged, and the state of the upstream
+// circuit breakers is reported, without affecting the status.
+func heartbeatHandler(client heartbeatRequester) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// assume the best, change if we encounter errors
-		st.Status = true
-		st.Checks.CheckAutographHeartbeat = true
-		resp, err := client.Get(heartbeatURL)
-		if err != nil {
-			st.Checks.CheckAutographHeartbeat = false
-			st.Status = false
-			st.Details = fmt.Sprintf("failed to request autograph heartbeat from %s: %v", heartbeatURL, err)
-			writeHeartbeatResponse(w, st)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			st.Checks.CheckAutographHeartbeat = false
-			st.Status = false
-			st.Details = fmt.Sprintf("upstream autograph returned heartbeat code %d %s", resp.StatusCode, resp.Status)
-			writeHeartbeatResponse(w, st)
-			return
+		var (
+			st      heartbeat
+			details []string
+		)
+		now := time.Now()
+		confMu.RLock()
+		warnings := findExpiringClientTokens(conf.Authorizations, now, conf.TokenExpiryWarning)
+		window := conf.TokenExpiryWarning
+		confMu.RUnlock()
+		expiryWarnings.log(warnings, now, window)
+		st.ExpiringClientTokens = len(warnings)
+		for _, ep := range conf.upstream.endpoints {
+			err := probeHeartbeat(client, ep.URL)
+			ep.setHealthy(err == nil, err)
+			if err != nil {
+				details = append(details, err.Error())
+			} else {
+				st.Status = true
+			}
+			st.Upstreams = append(st.Upstreams, upstreamHeartbeat{
+				URL:            ep.URL,
+				Healthy:        err == nil,
+				CircuitBreaker: ep.breaker.status(),
+			})
 		}
+		st.Checks.CheckAutographHeartbeat = st.Status
+		st.Details = strings.Join(details, "; ")
 		writeHeartbeatResponse(w, st)
 	}
 }
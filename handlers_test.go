@@ -2,18 +2,31 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/mozilla-services/autograph-edge/mock_main"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func Test_heartbeatHandler(t *testing.T) {
+	// report the state of a circuit breaker other tests didn't trip
+	savedUpstream := conf.upstream
+	defer func() { conf.upstream = savedUpstream }()
+	conf.upstream = newUpstreamClient(conf)
+
 	type args struct {
 		baseURL string
 		r       *http.Request
@@ -45,7 +58,7 @@ func Test_heartbeatHandler(t *testing.T) {
 			expectedResponse: expectedResponse{
 				status:      http.StatusOK,
 				contentType: "application/json",
-				body:        []byte("{\"status\":true,\"checks\":{\"check_autograph_heartbeat\":true},\"details\":\"\"}"),
+				body:        []byte("{\"status\":true,\"checks\":{\"check_autograph_heartbeat\":true},\"details\":\"\",\"upstreams\":[{\"url\":\"http://localhost:8000/\",\"healthy\":true,\"circuit_breaker\":\"closed\"}]}"),
 			},
 		},
 		{
@@ -63,7 +76,7 @@ func Test_heartbeatHandler(t *testing.T) {
 			expectedResponse: expectedResponse{
 				status:      http.StatusServiceUnavailable,
 				contentType: "application/json",
-				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"upstream autograph returned heartbeat code 502 Bad Gateway\"}"),
+				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"upstream autograph returned heartbeat code 502 Bad Gateway\",\"upstreams\":[{\"url\":\"http://localhost:8000/\",\"healthy\":false,\"circuit_breaker\":\"closed\"}]}"),
 			},
 		},
 		{
@@ -77,7 +90,7 @@ func Test_heartbeatHandler(t *testing.T) {
 			expectedResponse: expectedResponse{
 				status:      http.StatusServiceUnavailable,
 				contentType: "application/json",
-				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"failed to request autograph heartbeat from http://localhost:8000/__heartbeat__: Get \\\"http://localhost:8000/__heartbeat__\\\": dial tcp 127.0.0.1:8000: connect: connection refused \\u003cnil\\u003e\"}"),
+				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"failed to request autograph heartbeat from http://localhost:8000/__heartbeat__: Get \\\"http://localhost:8000/__heartbeat__\\\": dial tcp 127.0.0.1:8000: connect: connection refused \\u003cnil\\u003e\",\"upstreams\":[{\"url\":\"http://localhost:8000/\",\"healthy\":false,\"circuit_breaker\":\"closed\"}]}"),
 			},
 		},
 	}
@@ -97,7 +110,7 @@ func Test_heartbeatHandler(t *testing.T) {
 
 			w := httptest.NewRecorder()
 
-			heartbeatHandler(tt.args.baseURL, client)(w, tt.args.r)
+			heartbeatHandler(client)(w, tt.args.r)
 
 			resp := w.Result()
 			body, _ := io.ReadAll(resp.Body)
@@ -116,6 +129,49 @@ func Test_heartbeatHandler(t *testing.T) {
 
 }
 
+func TestHeartbeatExpiringClientTokens(t *testing.T) {
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.upstream = newUpstreamClient(conf)
+	conf.TokenExpiryWarning = 24 * time.Hour
+	conf.Authorizations = []authorization{
+		{
+			ClientTokens: []clientToken{
+				{
+					ClientToken: "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880",
+					ExpiresAt:   time.Now().Add(time.Hour),
+				},
+			},
+			User:   "bob",
+			Signer: "testapp-android",
+		},
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock_main.NewMockheartbeatRequester(ctrl)
+	client.EXPECT().Get(conf.BaseURL+"__heartbeat__").Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader([]byte("{}"))),
+	}, nil).AnyTimes()
+
+	w := httptest.NewRecorder()
+	heartbeatHandler(client)(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	var st heartbeat
+	err := json.Unmarshal(w.Body.Bytes(), &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ExpiringClientTokens != 1 {
+		t.Fatalf("heartbeatHandler() reported %d expiring client tokens expected 1", st.ExpiringClientTokens)
+	}
+	// the public heartbeat doesn't identify tokens or authorizations
+	for _, detail := range []string{"cbe16cb8ff1d11c5", "bob", "testapp-android"} {
+		if strings.Contains(w.Body.String(), detail) {
+			t.Fatalf("heartbeatHandler() returned %q in %s", detail, w.Body.String())
+		}
+	}
+}
+
 func TestVersion(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost:8080/__version__", nil)
 	w := httptest.NewRecorder()
@@ -153,3 +209,287 @@ func TestNotFoundHandler(t *testing.T) {
 		t.Fatalf("notFoundHandler returned unexpected content type: %q", resp.Header.Get("Content-Type"))
 	}
 }
+
+func TestSigHandlerSizeLimits(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+
+	// newRequest returns a /sign request uploading size bytes, with an
+	// unknown Content-Length when chunked is set
+	newRequest := func(size int, chunked bool) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("input", "app.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte("a"), size))
+		mw.Close()
+		var r *http.Request
+		if chunked {
+			r = httptest.NewRequest("POST", "http://localhost:8080/sign", io.MultiReader(&body))
+			r.ContentLength = -1
+		} else {
+			r = httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+		}
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", auth.ClientToken)
+		return r
+	}
+
+	tests := []struct {
+		name          string
+		maxBodyBytes  int64
+		maxInputBytes int64
+		size          int
+		chunked       bool
+		expectedCode  int
+		expectedBody  string
+		// the field logging the bytes read when the limit tripped
+		// and its expected value
+		readField    string
+		expectedRead int64
+	}{
+		{"no limits", 0, 0, 10000, false, http.StatusCreated, "", "", 0},
+		{"within the limits", 10000, 1000, 1000, false, http.StatusCreated, "", "", 0},
+		{"Content-Length over max_body_bytes", 1000, 0, 1000, false, http.StatusRequestEntityTooLarge, "request body is too large: the maximum is 1000 bytes", "bytes_read", 0},
+		{"chunked body over max_body_bytes", 1000, 0, 1000, true, http.StatusRequestEntityTooLarge, "request body is too large: the maximum is 1000 bytes", "bytes_read", 1000},
+		{"input over max_input_bytes", 10000, 999, 1000, false, http.StatusRequestEntityTooLarge, "input is too large for the authorization: the maximum is 999 bytes", "input_bytes_read", 1000},
+		{"chunked input over max_input_bytes", 0, 999, 1000, true, http.StatusRequestEntityTooLarge, "input is too large for the authorization: the maximum is 999 bytes", "input_bytes_read", 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Authorizations = append([]authorization{}, savedConf.Authorizations...)
+			conf.Authorizations[2].MaxInputBytes = tt.maxInputBytes
+			conf.MaxBodyBytes = tt.maxBodyBytes
+			handler := handleWithMiddleware(http.HandlerFunc(sigHandler), setRequestID(), limitRequestBody(conf.MaxBodyBytes))
+			hook := logtest.NewGlobal()
+			defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest(tt.size, tt.chunked))
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			if tt.expectedBody != "" && strings.TrimSpace(w.Body.String()) != tt.expectedBody {
+				t.Fatalf("sigHandler returned %q expected %q", w.Body.String(), tt.expectedBody)
+			}
+			if tt.readField == "" {
+				return
+			}
+			var logged *log.Entry
+			for _, entry := range hook.AllEntries() {
+				if _, ok := entry.Data[tt.readField]; ok {
+					logged = entry
+				}
+			}
+			if logged == nil {
+				t.Fatalf("sigHandler did not log %s", tt.readField)
+			}
+			if logged.Data[tt.readField] != tt.expectedRead {
+				t.Fatalf("sigHandler logged %s=%v expected %d", tt.readField, logged.Data[tt.readField], tt.expectedRead)
+			}
+		})
+	}
+}
+
+func TestSigHandlerSignatureHeaders(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("input", "app.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("unsigned"))
+	mw.Close()
+	r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", auth.ClientToken)
+	w := httptest.NewRecorder()
+	sigHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("sigHandler returned %d expected %d", w.Code, http.StatusCreated)
+	}
+	for name, expected := range map[string]string{
+		"X-Autograph-Ref":           "7khgpu4gcfdv30w8joqxjy1cc",
+		"X-Autograph-Type":          "apk2",
+		"X-Autograph-Signer-ID":     auth.Signer,
+		"X-Autograph-X5U":           "https://example.com/chain.pem",
+		"X-Autograph-Output-SHA256": "ceffe727ab2fa2c7c3322ee4a1aa0c2d2a4664836c2133df93dd15055bb617be",
+	} {
+		if w.Header().Get(name) != expected {
+			t.Errorf("sigHandler returned %s %q expected %q", name, w.Header().Get(name), expected)
+		}
+	}
+}
+
+func TestSigHandlerContentTypes(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, err := mw.CreateFormFile("input", "app.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("unsigned"))
+	mw.Close()
+	jsonRequest := `{"input":"` + base64.StdEncoding.EncodeToString([]byte("unsigned")) + `"}`
+
+	tests := []struct {
+		name                string
+		contentType         string
+		accept              string
+		body                string
+		expectedCode        int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"form data", mw.FormDataContentType(), "", form.String(), http.StatusCreated, "application/octet-stream", "unsigned"},
+		{"form data accepting JSON", mw.FormDataContentType(), "application/json", form.String(), http.StatusCreated, "application/json", ""},
+		{"JSON", "application/json; charset=utf-8", "", jsonRequest, http.StatusCreated, "application/json", ""},
+		{"octet-stream", "application/octet-stream", "", "unsigned", http.StatusCreated, "application/octet-stream", "unsigned"},
+		{"octet-stream accepting JSON", "application/octet-stream", "text/plain, application/json", "unsigned", http.StatusCreated, "application/json", ""},
+		{"JSON without input", "application/json", "", `{"keyid":"other"}`, http.StatusBadRequest, "", `{"code":"missing_input","message":"failed to decode JSON request: missing input","request_id":"-","retryable":false}` + "\n"},
+		{"invalid JSON", "application/json", "", "unsigned", http.StatusBadRequest, "", ""},
+		{"duplicate input", "application/json", "", `{"input":"QUFB","input":"QkJC"}`, http.StatusBadRequest, "", ""},
+		{"deeply nested field", "application/json", "", `{"options":` + strings.Repeat("[", 1<<20) + `,"input":"QUFB"}`, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			r.Header.Set("Authorization", auth.ClientToken)
+			w := httptest.NewRecorder()
+			sigHandler(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			if tt.expectedBody != "" && w.Body.String() != tt.expectedBody {
+				t.Fatalf("sigHandler returned %q expected %q", w.Body.String(), tt.expectedBody)
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+			if w.Header().Get("Content-Type") != tt.expectedContentType {
+				t.Fatalf("sigHandler returned content type %q expected %q", w.Header().Get("Content-Type"), tt.expectedContentType)
+			}
+			if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+				t.Fatalf("sigHandler returned Content-Length %s for a %d bytes body", w.Header().Get("Content-Length"), w.Body.Len())
+			}
+			if tt.expectedContentType != "application/json" {
+				return
+			}
+			var response signResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("sigHandler returned invalid JSON %s: %s", w.Body.String(), err)
+			}
+			expected := signResponse{
+				SignedFile:   base64.StdEncoding.EncodeToString([]byte("unsigned")),
+				Ref:          "7khgpu4gcfdv30w8joqxjy1cc",
+				Type:         "apk2",
+				SignerID:     auth.Signer,
+				X5U:          "https://example.com/chain.pem",
+				OutputSHA256: "ceffe727ab2fa2c7c3322ee4a1aa0c2d2a4664836c2133df93dd15055bb617be",
+			}
+			if response != expected {
+				t.Fatalf("sigHandler returned %+v expected %+v", response, expected)
+			}
+		})
+	}
+}
+
+func TestSigHandlerAutographErrors(t *testing.T) {
+	auth := conf.Authorizations[2]
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.AutographMaxAttempts = 1
+
+	tests := []struct {
+		name         string
+		status       int
+		errorBody    string
+		expectedCode int
+		expected     errorResponse
+	}{
+		{"bad input", http.StatusBadRequest, "invalid apk\x1b[0m\n", http.StatusBadRequest,
+			errorResponse{Code: codeAutographRejectedInput, Message: "autograph rejected the input: invalid apk [0m"}},
+		{"bad input without message", http.StatusBadRequest, "", http.StatusBadRequest,
+			errorResponse{Code: codeAutographRejectedInput, Message: "autograph rejected the input"}},
+		{"input too large", http.StatusRequestEntityTooLarge, "", http.StatusRequestEntityTooLarge,
+			errorResponse{Code: codeInputTooLarge, Message: "input is too large for autograph"}},
+		{"unauthorized", http.StatusUnauthorized, "invalid hawk authorization", http.StatusBadGateway,
+			errorResponse{Code: codeAutographUnauthorized, Message: "autograph refused the authorization of the edge"}},
+		{"forbidden", http.StatusForbidden, "signer not allowed", http.StatusBadGateway,
+			errorResponse{Code: codeAutographUnauthorized, Message: "autograph refused the authorization of the edge"}},
+		{"not found", http.StatusNotFound, "", http.StatusBadGateway,
+			errorResponse{Code: codeAutographRequestRejected, Message: "failed to call autograph for signature"}},
+		{"rate limited", http.StatusTooManyRequests, "slow down", http.StatusServiceUnavailable,
+			errorResponse{Code: codeAutographUnavailable, Message: "autograph is overloaded, try again later", Retryable: true}},
+		{"overloaded", http.StatusServiceUnavailable, "overloaded", http.StatusServiceUnavailable,
+			errorResponse{Code: codeAutographUnavailable, Message: "autograph is overloaded, try again later", Retryable: true}},
+		{"internal error", http.StatusInternalServerError, "database password is hunter2", http.StatusBadGateway,
+			errorResponse{Code: codeAutographError, Message: "failed to call autograph for signature", Retryable: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			autograph := newTestAutograph(t, auth, testAutographResponse{status: tt.status, errorBody: tt.errorBody})
+			defer autograph.Close()
+			conf.BaseURL = autograph.URL + "/"
+			conf.upstream = newUpstreamClient(conf)
+
+			r := httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader("unsigned"))
+			r.Header.Set("Content-Type", "application/octet-stream")
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("Authorization", auth.ClientToken)
+			w := httptest.NewRecorder()
+			sigHandler(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("sigHandler returned %d expected %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			var response errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.RequestID = ""
+			if response != tt.expected {
+				t.Fatalf("sigHandler returned %+v expected %+v", response, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_setSignatureHeaders(t *testing.T) {
+	h := http.Header{}
+	setSignatureHeaders(h, signatureresponse{Ref: "abc", SignerID: "testapp-android"}, "")
+	if len(h) != 2 || h.Get("X-Autograph-Ref") != "abc" || h.Get("X-Autograph-Signer-ID") != "testapp-android" {
+		t.Fatalf("setSignatureHeaders() set %v expected only the ref and signer ID", h)
+	}
+}
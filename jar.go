@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSignatureFileSize is the largest signature or manifest file we're
+// willing to decompress from a signed file
+const maxSignatureFileSize = 32 << 20
+
+// zipContents holds the digests of the files of a zip archive, by file
+// name and digest algorithm, and the content of its signature files
+type zipContents struct {
+	digests        map[string]map[string][]byte
+	signatureFiles map[string][]byte
+}
+
+// computeDigests returns the digests of data that JAR manifests and
+// signature files can be verified with
+func computeDigests(r io.Reader) (map[string][]byte, error) {
+	hashes := map[string]hash.Hash{
+		"SHA1":   sha1.New(),
+		"SHA256": sha256.New(),
+	}
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	_, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string][]byte, len(hashes))
+	for name, h := range hashes {
+		digests[name] = h.Sum(nil)
+	}
+	return digests, nil
+}
+
+// readZipContents returns the digests of the files of a zip archive and
+// the content of the ones isSignatureFile returns true for. Archives
+// with duplicate file names are rejected since they could be verified
+// and installed with different content.
+func readZipContents(r *io.SectionReader, isSignatureFile func(name string) bool) (contents zipContents, err error) {
+	zr, err := zip.NewReader(r, r.Size())
+	if err != nil {
+		return contents, errors.Wrap(err, "failed to read zip archive")
+	}
+	contents.digests = make(map[string]map[string][]byte)
+	contents.signatureFiles = make(map[string][]byte)
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if _, exists := contents.digests[f.Name]; exists {
+			return contents, fmt.Errorf("duplicate file %s", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return contents, errors.Wrapf(err, "failed to open %s", f.Name)
+		}
+		var r io.Reader = rc
+		var content bytes.Buffer
+		if isSignatureFile(f.Name) {
+			r = io.TeeReader(io.LimitReader(rc, maxSignatureFileSize+1), &content)
+		}
+		digests, err := computeDigests(r)
+		rc.Close()
+		if err != nil {
+			return contents, errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		if isSignatureFile(f.Name) {
+			if content.Len() > maxSignatureFileSize {
+				return contents, fmt.Errorf("%s is larger than %d bytes", f.Name, maxSignatureFileSize)
+			}
+			contents.signatureFiles[f.Name] = content.Bytes()
+		}
+		contents.digests[f.Name] = digests
+	}
+	return contents, nil
+}
+
+// compareZipContents returns an error unless the signed archive
+// contains the same files as the input besides signature files
+func compareZipContents(input, signed zipContents) error {
+	for name, digests := range signed.digests {
+		if _, isSignature := signed.signatureFiles[name]; isSignature {
+			continue
+		}
+		inputDigests, exists := input.digests[name]
+		if !exists {
+			return fmt.Errorf("signed file contains %s which is not in the input", name)
+		}
+		if !bytes.Equal(inputDigests["SHA256"], digests["SHA256"]) {
+			return fmt.Errorf("content of %s differs between the input and signed file", name)
+		}
+	}
+	for name := range input.digests {
+		if _, isSignature := input.signatureFiles[name]; isSignature {
+			continue
+		}
+		if _, exists := signed.digests[name]; !exists {
+			return fmt.Errorf("signed file is missing %s", name)
+		}
+	}
+	return nil
+}
+
+// jarSection is the attributes of a section of a JAR manifest or
+// signature file
+type jarSection map[string]string
+
+// parseJARManifest parses a JAR manifest or signature file into its
+// main section and the sections of the files it lists by name
+func parseJARManifest(data []byte) (main jarSection, entries map[string]jarSection, err error) {
+	var (
+		sections []jarSection
+		section  jarSection
+		lastKey  string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxSignatureFileSize)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			section, lastKey = nil, ""
+		case strings.HasPrefix(line, " "):
+			if lastKey == "" {
+				return nil, nil, fmt.Errorf("continuation line without an attribute")
+			}
+			section[lastKey] += line[1:]
+		default:
+			key, value, found := strings.Cut(line, ": ")
+			if !found {
+				return nil, nil, fmt.Errorf("invalid manifest line %q", line)
+			}
+			if section == nil {
+				section = make(jarSection)
+				sections = append(sections, section)
+			}
+			section[key] = value
+			lastKey = key
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sections) == 0 {
+		return nil, nil, fmt.Errorf("empty manifest")
+	}
+	entries = make(map[string]jarSection)
+	for _, section := range sections[1:] {
+		name := section["Name"]
+		if name == "" {
+			return nil, nil, fmt.Errorf("manifest section without a name")
+		}
+		if _, exists := entries[name]; exists {
+			return nil, nil, fmt.Errorf("duplicate manifest section %s", name)
+		}
+		entries[name] = section
+	}
+	return sections[0], entries, nil
+}
+
+// verifyJARDigests checks the digest attributes ending in suffix of a
+// manifest section against the digests of a file. Digests of
+// unsupported algorithms like MD5 are ignored, but at least one must
+// be supported.
+func verifyJARDigests(section jarSection, suffix string, digests map[string][]byte) error {
+	verified := false
+	for key, value := range section {
+		if len(key) <= len(suffix) || !strings.EqualFold(key[len(key)-len(suffix):], suffix) {
+			continue
+		}
+		algorithm := strings.ToUpper(strings.ReplaceAll(key[:len(key)-len(suffix)], "-", ""))
+		expected, supported := digests[algorithm]
+		if !supported {
+			continue
+		}
+		got, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || !bytes.Equal(got, expected) {
+			return fmt.Errorf("%s%s does not match", key[:len(key)-len(suffix)], suffix)
+		}
+		verified = true
+	}
+	if !verified {
+		return fmt.Errorf("no supported %s digest", strings.TrimPrefix(suffix, "-"))
+	}
+	return nil
+}
+
+// verifyJARManifest checks that a manifest lists every file of a zip
+// archive but the excluded ones, that it lists no other files, and
+// that their digests match
+func verifyJARManifest(contents zipContents, manifestName string, entries map[string]jarSection, excluded func(name string) bool) error {
+	for name, digests := range contents.digests {
+		if excluded(name) {
+			continue
+		}
+		section, listed := entries[name]
+		if !listed {
+			return fmt.Errorf("%s is not listed in %s", name, manifestName)
+		}
+		err := verifyJARDigests(section, "-Digest", digests)
+		if err != nil {
+			return fmt.Errorf("%s of %s in %s", err, name, manifestName)
+		}
+	}
+	for name := range entries {
+		if _, exists := contents.digests[name]; !exists || excluded(name) {
+			return fmt.Errorf("%s lists %s which is not signed", manifestName, name)
+		}
+	}
+	return nil
+}
+
+// verifyJARSignatureFile checks that a signature file holds the digest
+// of the whole manifest
+func verifyJARSignatureFile(sf, manifest []byte) error {
+	main, _, err := parseJARManifest(sf)
+	if err != nil {
+		return err
+	}
+	digests, err := computeDigests(bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	return verifyJARDigests(main, "-Digest-Manifest", digests)
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/x509"
 	_ "embed"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -20,12 +25,36 @@ import (
 )
 
 var (
-	errInvalidToken              = errors.New("invalid authorization token")
-	errInvalidMethod             = errors.New("only POST requests are supported")
-	errMissingBody               = errors.New("missing request body")
-	errAutographBadStatusCode    = errors.New("failed to retrieve signature from autograph")
-	errAutographBadResponseCount = errors.New("received an invalid number of responses from autograph")
-	errAutographEmptyResponse    = errors.New("autograph returned an invalid empty response")
+	errInvalidToken                 = errors.New("invalid authorization token")
+	errTokenExpired                 = errors.New("authorization token has expired")
+	errTokenNotYetValid             = errors.New("authorization token is not valid yet")
+	errInvalidOIDCToken             = errors.New("invalid OIDC identity token")
+	errNoOIDCAuthorization          = errors.New("no authorization matches the OIDC identity token claims")
+	errInvalidClientCert            = errors.New("no authorization matches the client certificate")
+	errClientCertRequired           = errors.New("authorization requires a matching client certificate")
+	errClientIPNotAllowed           = errors.New("client IP is not allowed for the authorization")
+	errInvalidMethod                = errors.New("only POST requests are supported")
+	errMissingBody                  = errors.New("missing request body")
+	errMissingInput                 = errors.New("missing input")
+	errBodyTooLarge                 = errors.New("request body is too large")
+	errInputTooLarge                = errors.New("input is too large for the authorization")
+	errRateLimited                  = errors.New("rate limit of the authorization exceeded")
+	errTooManyConcurrentSignings    = errors.New("too many concurrent signings for the authorization")
+	errAtCapacity                   = errors.New("too many concurrent signings, try again later")
+	errQuotaExceeded                = errors.New("signing quota of the authorization exceeded")
+	errAutographBadStatusCode       = errors.New("failed to retrieve signature from autograph")
+	errAutographBadResponseCount    = errors.New("received an invalid number of responses from autograph")
+	errAutographEmptyResponse       = errors.New("autograph returned an invalid empty response")
+	errAutographCircuitOpen         = errors.New("autograph circuit breaker is open")
+	errAutographInvalidResponseAuth = errors.New("invalid autograph response authorization")
+	errSignatureVerification        = errors.New("signature returned by autograph failed verification")
+	errXPIInvalid                   = errors.New("invalid XPI")
+	errXPIMissingManifest           = errors.New("XPI does not contain a manifest.json or install.rdf")
+	errXPIAddonIDMismatch           = errors.New("XPI add-on ID does not match authorization")
+	errAPKInvalid                   = errors.New("invalid APK")
+	errAPKMissingManifest           = errors.New("APK does not contain an AndroidManifest.xml")
+	errAPKPackageMismatch           = errors.New("APK package name does not match authorization")
+	errAPKVersionCodeTooLow         = errors.New("APK version code is lower than the authorized minimum")
 
 	conf configuration
 )
@@ -35,16 +64,173 @@ type configuration struct {
 	Host           string
 	BaseURL        string `yaml:"autograph_base_url"`
 	Authorizations []authorization
+
+	// OIDC enables authenticating with identity tokens matched against
+	// the OIDCClaims of authorizations
+	OIDC *oidcConfiguration `yaml:"oidc"`
+
+	// TLSCert and TLSKey are paths to the PEM encoded certificate
+	// and key to serve HTTPS with instead of HTTP. They are checked
+	// for changes every TLSReloadInterval and on SIGHUP.
+	TLSCert           string        `yaml:"tls_cert"`
+	TLSKey            string        `yaml:"tls_key"`
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval"`
+	certs             *certReloader
+
+	// TLSClientCA is the path to a PEM bundle of CAs that issue client
+	// certificates authorizations can be bound to
+	TLSClientCA string `yaml:"tls_client_ca"`
+	clientCAs   *x509.CertPool
+
+	// TokenExpiryWarning is how long before a client token expires the
+	// heartbeat starts warning about it
+	TokenExpiryWarning time.Duration `yaml:"token_expiry_warning"`
+
+	// ConfigReloadInterval is how often the configuration file is
+	// checked for changes to reload it. Zero disables checking, the
+	// configuration is still reloaded on SIGHUP.
+	ConfigReloadInterval time.Duration `yaml:"config_reload_interval"`
+
+	// AutographUpstreams lists autograph endpoints to use instead of
+	// BaseURL. Requests go to the healthy upstreams with the lowest
+	// priority, spread by weight, and fail over to the others. The
+	// heartbeat of every upstream is checked every
+	// AutographHealthCheckInterval.
+	AutographUpstreams           []upstreamConfiguration `yaml:"autograph_upstreams"`
+	AutographHealthCheckInterval time.Duration           `yaml:"autograph_health_check_interval"`
+
+	// AutographConnectTimeout and AutographResponseTimeout bound the
+	// time to connect to autograph and to wait for its response, and
+	// AutographAttemptTimeout a whole attempt including the transfer of
+	// the request and response bodies.
+	// Requests that fail to connect or get a 502, 503 or 504 are
+	// attempted up to AutographMaxAttempts times, waiting about
+	// AutographRetryBackoff doubled after each attempt. After
+	// AutographCircuitBreakerThreshold consecutive failures, requests
+	// fail without calling an upstream for
+	// AutographCircuitBreakerCooldown.
+	AutographConnectTimeout          time.Duration `yaml:"autograph_connect_timeout"`
+	AutographResponseTimeout         time.Duration `yaml:"autograph_response_timeout"`
+	AutographAttemptTimeout          time.Duration `yaml:"autograph_attempt_timeout"`
+	AutographMaxAttempts             int           `yaml:"autograph_max_attempts"`
+	AutographRetryBackoff            time.Duration `yaml:"autograph_retry_backoff"`
+	AutographCircuitBreakerThreshold int           `yaml:"autograph_circuit_breaker_threshold"`
+	AutographCircuitBreakerCooldown  time.Duration `yaml:"autograph_circuit_breaker_cooldown"`
+
+	// upstream sends requests to the upstream autographs
+	upstream *upstreamClient
+
+	// ShutdownDrainPeriod is how long /__lbheartbeat__ reports the
+	// server as unhealthy on SIGTERM or SIGINT before it stops
+	// accepting connections, and ShutdownTimeout how long in-flight
+	// requests then have to complete
+	ShutdownDrainPeriod time.Duration `yaml:"shutdown_drain_period"`
+	ShutdownTimeout     time.Duration `yaml:"shutdown_timeout"`
+
+	// VerifySignatures enables checking the signatures of the files
+	// returned by autograph, and that they have the content of the
+	// input, before returning them. Add-on signatures must chain to
+	// one of the PEM encoded AddonRootCerts.
+	VerifySignatures bool   `yaml:"verify_signatures"`
+	AddonRootCerts   string `yaml:"addon_root_certs"`
+	addonRoots       *x509.CertPool
+
+	// MaxConcurrentSignings caps the /sign requests handled at the
+	// same time, to protect autograph. Zero means no limit.
+	MaxConcurrentSignings int `yaml:"max_concurrent_signings"`
+
+	// MaxBodyBytes is the largest /sign request body accepted, larger
+	// ones are rejected with a 413. Zero means no limit.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+
+	// TempDir is the directory inputs and signed files are stored in
+	// while they're signed, instead of memory. It defaults to the
+	// system's directory for temporary files.
+	TempDir string `yaml:"temp_dir"`
+
+	// QuotaFile is where the number of files signed by each
+	// authorization is saved, so their quotas survive restarts
+	QuotaFile string `yaml:"quota_file"`
+	quotas    *quotaStore
+
+	// AuditLog is the file signings are recorded in, as hash chained
+	// JSON lines that verify-audit checks
+	AuditLog string `yaml:"audit_log"`
+	auditLog *auditLog
+
+	// TrustedProxies are the CIDRs of the proxies in front of the
+	// edge whose ClientIPHeader entries are trusted to find the IP of
+	// clients. ClientIPHeader is X-Forwarded-For or Forwarded.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	ClientIPHeader string   `yaml:"client_ip_header"`
+	trustedProxies []netip.Prefix
+
+	// MetricsPort is the port /__metrics__ is served on, on the same
+	// host. When unset, it is served alongside /sign.
+	MetricsPort int `yaml:"metrics_port"`
+
+	// path and baseURLOverride are the configuration file and command
+	// line autograph base URL the configuration was loaded with
+	path, baseURLOverride string
 }
 
 type authorization struct {
-	ClientToken         string `yaml:"client_token"`
+	// ID identifies the authorization for its rate limits, concurrency
+	// caps and quotas. It defaults to the user and signer, and must be
+	// set to tell apart authorizations with the same ones that have
+	// limits or quotas.
+	ID string `yaml:"id"`
+
+	ClientToken       string        `yaml:"client_token"`
+	ClientTokenSHA256 string        `yaml:"client_token_sha256"`
+	ClientTokenSalt   string        `yaml:"client_token_salt"`
+	NotBefore         time.Time     `yaml:"not_before"`
+	ExpiresAt         time.Time     `yaml:"expires_at"`
+	ClientTokens      []clientToken `yaml:"client_tokens"`
+
+	// OIDCClaims are the claims an OIDC identity token must have to
+	// use this authorization e.g. repository, ref and workflow
+	OIDCClaims map[string]string `yaml:"oidc_claims"`
+
+	// ClientCertSubjects and ClientCertSPKISHA256 bind the authorization
+	// to verified client certificates by subject DN or hex encoded
+	// SHA-256 of their SubjectPublicKeyInfo. If RequireClientCert is
+	// set, the client certificate is required in addition to a token.
+	ClientCertSubjects   []string `yaml:"client_cert_subjects"`
+	ClientCertSPKISHA256 []string `yaml:"client_cert_spki_sha256"`
+	RequireClientCert    bool     `yaml:"require_client_cert"`
+
 	Signer              string
 	User                string
 	Key                 string
 	AddonID             string
 	AddonPKCS7Digest    string
 	AddonCOSEAlgorithms []string
+	APKPackageName      string `yaml:"apk_package_name"`
+	APKMinVersionCode   int64  `yaml:"apk_min_version_code"`
+
+	// MaxInputBytes is the size of the largest file the authorization
+	// can upload. Zero means no limit besides MaxBodyBytes.
+	MaxInputBytes int64 `yaml:"max_input_bytes"`
+
+	// RateLimitPerMinute and RateLimitBurst configure a token bucket
+	// limiting the signing requests of the authorization, and
+	// MaxConcurrentSignings how many it can make at the same time.
+	// Zero means no limit. The burst defaults to a minute worth of
+	// requests.
+	RateLimitPerMinute    float64 `yaml:"rate_limit_per_minute"`
+	RateLimitBurst        int     `yaml:"rate_limit_burst"`
+	MaxConcurrentSignings int     `yaml:"max_concurrent_signings"`
+
+	// DailyQuota and MonthlyQuota are how many files the authorization
+	// can sign per UTC day and month. Zero means no quota.
+	DailyQuota   int `yaml:"daily_quota"`
+	MonthlyQuota int `yaml:"monthly_quota"`
+
+	// AllowedCIDRs restricts the IPs of the clients that can use the
+	// authorization. Empty means any IP.
+	AllowedCIDRs    []string `yaml:"allowed_cidrs"`
+	allowedPrefixes []netip.Prefix
 }
 
 //go:generate ./version.sh version.json
@@ -57,55 +243,213 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAuditCommand(os.Args[2:]))
+	}
 	parseArgsAndLoadConf()
+	if conf.AuditLog != "" {
+		var err error
+		conf.auditLog, err = openAuditLog(conf.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	server := prepareServer(conf.Host, conf.Port)
 
-	log.Infof("starting autograph-edge on %s:%d with upstream autograph base URL %s", conf.Host, conf.Port, conf.BaseURL)
-	err := server.ListenAndServe()
-	if err != nil {
+	go reloadOnSIGHUP()
+	if conf.ConfigReloadInterval > 0 {
+		go watchConf(conf.ConfigReloadInterval)
+	}
+
+	if conf.MetricsPort != 0 {
+		go func() {
+			log.Infof("serving metrics on %s:%d", conf.Host, conf.MetricsPort)
+			log.Fatal(prepareMetricsServer(conf.Host, conf.MetricsPort).ListenAndServe())
+		}()
+	}
+
+	stopped := shutdownOnSignal(server, conf.ShutdownDrainPeriod, conf.ShutdownTimeout)
+
+	go conf.upstream.watchHealth(conf.AutographHealthCheckInterval)
+
+	log.Infof("starting autograph-edge on %s:%d with upstream autograph base URLs %s", conf.Host, conf.Port, conf.upstreamURLs())
+	var err error
+	if conf.certs != nil {
+		go conf.certs.watch(conf.TLSReloadInterval)
+		// the certificate comes from server.TLSConfig.GetCertificate
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
+	log.Info("autograph-edge stopped")
 }
 
 func parseArgsAndLoadConf() {
 	var (
 		cfgFile          string
 		autographBaseURL string
+		err              error
 	)
 	flag.StringVar(&cfgFile, "c", "autograph-edge.yaml", "Path to configuration file")
 	flag.StringVar(&autographBaseURL, "u", "", "Upstream Autograph Base URL with a trailing slash e.g. http://localhost:8000/")
 	flag.Parse()
 
-	err := conf.loadFromFile(cfgFile)
+	conf, err = loadConf(cfgFile, autographBaseURL)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for i, auth := range conf.Authorizations {
+}
+
+// loadConf parses the configuration file, and loads the TLS
+// certificates, add-on roots, quota store and upstream client that are
+// only set up at startup
+func loadConf(path, autographBaseURL string) (c configuration, err error) {
+	c, err = parseConf(path, autographBaseURL)
+	if err != nil {
+		return
+	}
+	err = loadTLSConfiguration(&c)
+	if err != nil {
+		return
+	}
+	err = loadAddonRoots(&c)
+	if err != nil {
+		return
+	}
+	c.quotas, err = loadQuotaStore(c.QuotaFile)
+	if err != nil {
+		return
+	}
+	c.upstream = newUpstreamClient(c)
+	return
+}
+
+// parseConf loads the configuration file, validates it, and sets
+// defaults for missing optional settings, without loading the files
+// or building the clients of the settings that require a restart. The
+// autograph base URL from the command line, if any, overrides the
+// configured one.
+func parseConf(path, autographBaseURL string) (c configuration, err error) {
+	err = c.loadFromFile(path)
+	if err != nil {
+		return
+	}
+	c.path, c.baseURLOverride = path, autographBaseURL
+
+	for i, auth := range c.Authorizations {
 		err = validateAuth(auth)
 		if err != nil {
-			log.Fatalf("error validating auth %d %q", i, err)
+			err = fmt.Errorf("error validating auth %d %q", i, err)
+			return
+		}
+		c.Authorizations[i].allowedPrefixes, err = parsePrefixes(auth.AllowedCIDRs)
+		if err != nil {
+			err = fmt.Errorf("error validating auth %d allowed_cidrs %q", i, err)
+			return
 		}
 	}
-	err = findDuplicateClientToken(conf.Authorizations)
+	err = validateClientIPConfiguration(&c)
 	if err != nil {
-		log.Fatal(err)
+		return
+	}
+	err = findDuplicateClientToken(c.Authorizations)
+	if err != nil {
+		return
+	}
+	err = validateIdentities(c.Authorizations)
+	if err != nil {
+		return
+	}
+	err = validateOIDCConfiguration(&c)
+	if err != nil {
+		return
+	}
+	err = validateTLSConfiguration(&c)
+	if err != nil {
+		return
+	}
+	err = validateSignatureVerification(&c)
+	if err != nil {
+		return
+	}
+	if c.MaxConcurrentSignings < 0 {
+		err = fmt.Errorf("max_concurrent_signings is negative (%d)", c.MaxConcurrentSignings)
+		return
+	}
+	if c.MaxBodyBytes < 0 {
+		err = fmt.Errorf("max_body_bytes is negative (%d)", c.MaxBodyBytes)
+		return
+	}
+	if c.TempDir != "" {
+		var info os.FileInfo
+		info, err = os.Stat(c.TempDir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("temp_dir %q is not a directory", c.TempDir)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = validateQuotas(&c)
+	if err != nil {
+		return
 	}
 
 	if autographBaseURL != "" {
-		log.Infof("using commandline autograph URL %s instead of conf %s", autographBaseURL, conf.BaseURL)
-		conf.BaseURL = autographBaseURL
+		log.Infof("using commandline autograph URL %s instead of conf %s", autographBaseURL, c.upstreamURLs())
+		c.BaseURL = autographBaseURL
+		c.AutographUpstreams = nil
 	}
-	err = validateBaseURL(conf.BaseURL)
+	err = validateUpstreamConfiguration(&c)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 
-	if conf.Host == "" {
-		conf.Host = "0.0.0.0"
+	if c.Host == "" {
+		c.Host = "0.0.0.0"
+	}
+	if c.Port == 0 {
+		c.Port = 8080
+	}
+	if c.TLSReloadInterval == 0 {
+		c.TLSReloadInterval = time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
 	}
-	if conf.Port == 0 {
-		conf.Port = 8080
+	if c.TokenExpiryWarning == 0 {
+		c.TokenExpiryWarning = 7 * 24 * time.Hour
 	}
+	if c.AutographHealthCheckInterval == 0 {
+		c.AutographHealthCheckInterval = 10 * time.Second
+	}
+	if c.AutographConnectTimeout == 0 {
+		c.AutographConnectTimeout = 5 * time.Second
+	}
+	if c.AutographResponseTimeout == 0 {
+		c.AutographResponseTimeout = 2 * time.Minute
+	}
+	if c.AutographAttemptTimeout == 0 {
+		c.AutographAttemptTimeout = 5 * time.Minute
+	}
+	if c.AutographMaxAttempts == 0 {
+		c.AutographMaxAttempts = 3
+	}
+	if c.AutographRetryBackoff == 0 {
+		c.AutographRetryBackoff = 100 * time.Millisecond
+	}
+	if c.AutographCircuitBreakerThreshold == 0 {
+		c.AutographCircuitBreakerThreshold = 5
+	}
+	if c.AutographCircuitBreakerCooldown == 0 {
+		c.AutographCircuitBreakerCooldown = 30 * time.Second
+	}
+	return
 }
 
 func prepareServer(host string, port int) *http.Server {
@@ -115,6 +459,17 @@ func prepareServer(host string, port int) *http.Server {
 		handleWithMiddleware(
 			http.HandlerFunc(sigHandler),
 			setRequestID(),
+			setClientAddress(),
+			observeSignRequest(),
+			setResponseHeaders(),
+			limitRequestBody(conf.MaxBodyBytes),
+		),
+	)
+	mux.Handle("/usage",
+		handleWithMiddleware(
+			http.HandlerFunc(usageHandler),
+			setRequestID(),
+			setClientAddress(),
 			setResponseHeaders(),
 		),
 	)
@@ -127,27 +482,35 @@ func prepareServer(host string, port int) *http.Server {
 	mux.Handle("/__heartbeat__",
 		handleWithMiddleware(
 			http.HandlerFunc(
-				heartbeatHandler(conf.BaseURL, &heartbeatClient{&http.Client{}}),
+				heartbeatHandler(conf.upstream),
 			),
 			setResponseHeaders(),
 		),
 	)
 	mux.Handle("/__lbheartbeat__",
 		handleWithMiddleware(
-			http.HandlerFunc(versionHandler),
+			http.HandlerFunc(lbHeartbeatHandler),
 			setResponseHeaders(),
 		),
 	)
+	if conf.MetricsPort == 0 {
+		mux.Handle("/__metrics__", metricsHandler())
+	}
 	mux.Handle("/",
 		handleWithMiddleware(
 			http.HandlerFunc(notFoundHandler),
 			setResponseHeaders(),
 		),
 	)
-	return &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", host, port),
-		Handler: mux,
+	server := &http.Server{
+		Addr:        fmt.Sprintf("%s:%d", host, port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return requestsContext },
 	}
+	if conf.certs != nil {
+		server.TLSConfig = serverTLSConfig(conf.certs, conf.clientCAs)
+	}
+	return server
 }
 
 // loadFromFile reads a configuration from a local file
@@ -177,18 +540,72 @@ func (c *configuration) loadFromFile(path string) error {
 	return nil
 }
 
-func authorize(authHeader string) (auth authorization, err error) {
+// authorize returns the authorization matching the Authorization
+// header and verified client certificate of a request, or an error
+// when none matches. Requests without an Authorization header can be
+// authorized by their client certificate alone.
+func authorize(authHeader string, clientCert *x509.Certificate) (auth authorization, err error) {
+	// identity tokens are verified before taking the read lock because
+	// fetching the JWKS would block reloads and the requests queued
+	// behind them
+	confMu.RLock()
+	oidc := conf.OIDC
+	confMu.RUnlock()
+	var claims map[string]interface{}
+	if authHeader != "" && oidc != nil && isJWT(authHeader) {
+		claims, err = verifyOIDC(oidc, authHeader)
+		if err != nil {
+			return authorization{}, err
+		}
+	}
+
+	confMu.RLock()
+	defer confMu.RUnlock()
+
+	switch {
+	case authHeader == "" && clientCert != nil:
+		return authorizeClientCert(clientCert)
+	case claims != nil:
+		auth, err = authorizeOIDC(claims)
+	default:
+		auth, err = authorizeClientToken(authHeader)
+	}
+	if err != nil {
+		return authorization{}, err
+	}
+	if auth.RequireClientCert && !auth.matchesClientCert(clientCert) {
+		return authorization{}, errClientCertRequired
+	}
+	return auth, nil
+}
+
+// authorizeClientToken returns the authorization with a client token
+// matching the Authorization header, or an error when none matches or
+// the matching token is outside its validity period
+func authorizeClientToken(authHeader string) (auth authorization, err error) {
+	now := time.Now()
 	for _, auth := range conf.Authorizations {
-		if subtle.ConstantTimeCompare([]byte(authHeader), []byte(auth.ClientToken)) == 1 {
+		for _, token := range auth.clientTokens() {
+			if !token.matches(authHeader) {
+				continue
+			}
+			err = token.checkValidity(now)
+			if err != nil {
+				return authorization{}, err
+			}
 			return auth, nil
 		}
 	}
 	return authorization{}, errInvalidToken
 }
 
-func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessage string, args ...interface{}) {
+// httpError responds to a request with an error status and message. The
+// response is an errorResponse with the code of the error when the
+// client sends or accepts JSON, and the message in plain text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, status int, code string, errorMessage string, args ...interface{}) {
 	log.WithFields(log.Fields{
-		"code": errorCode,
+		"code":       status,
+		"error_code": code,
 	}).Errorf(errorMessage, args...)
 	msg := fmt.Sprintf(errorMessage, args...)
 
@@ -199,33 +616,96 @@ func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessa
 		io.Copy(io.Discard, r.Body)
 		r.Body.Close()
 	}
-	http.Error(w, msg, errorCode)
-	return
+	if !wantsJSON(r) {
+		http.Error(w, msg, status)
+		return
+	}
+	body, err := json.Marshal(errorResponse{
+		Code:      code,
+		Message:   msg,
+		RequestID: getRequestID(r),
+		Retryable: retryableCodes[code],
+	})
+	if err != nil {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", mediaTypeJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
 }
 
 // findDuplicateClientToken returns an error if it finds a duplicate
-// token in a slice of authorizations
+// token in a slice of authorizations. Plaintext tokens are compared
+// to hashed ones by hashing them with every salt in use, but hashed
+// tokens with different salts cannot be compared to each other.
 func findDuplicateClientToken(auths []authorization) error {
-	// a map of token to index in the auths slice
-	seenTokenIndexes := map[string]int{}
+	type saltedHash struct {
+		salt, hash string
+	}
+	// a map of salted token hash to index in the auths slice
+	seenTokenIndexes := map[saltedHash]int{}
 
+	salts := map[string]bool{"": true}
+	for _, auth := range auths {
+		for _, token := range auth.clientTokens() {
+			if token.ClientTokenSHA256 != "" {
+				salts[token.ClientTokenSalt] = true
+			}
+		}
+	}
 	for i, auth := range auths {
-		seenTokenIndex, exists := seenTokenIndexes[auth.ClientToken]
-		if exists {
-			return fmt.Errorf("found duplicate client token at positions %d and %d", seenTokenIndex, i)
+		var hashes []saltedHash
+		for _, token := range auth.clientTokens() {
+			if token.ClientTokenSHA256 != "" {
+				hashes = append(hashes, saltedHash{token.ClientTokenSalt, strings.ToLower(token.ClientTokenSHA256)})
+				continue
+			}
+			for salt := range salts {
+				hashes = append(hashes, saltedHash{salt, hashClientToken(salt, token.ClientToken)})
+			}
+		}
+		for _, hash := range hashes {
+			seenTokenIndex, exists := seenTokenIndexes[hash]
+			if exists {
+				return fmt.Errorf("found duplicate client token at positions %d and %d", seenTokenIndex, i)
+			}
+			seenTokenIndexes[hash] = i
 		}
-		seenTokenIndexes[auth.ClientToken] = i
 	}
 	return nil
 }
 
 // vaidateAuth returns an error for auths with:
 //
-// a short (<60 chars) ClientToken
+// no client token, OIDC claims or client certificate binding
+// an invalid client token (see clientToken.validate)
+// a client certificate requirement without a token or binding
 // missing or empty required field autograph user, signer, or key
+// both add-on and APK policies, or a negative APK minimum version code
 func validateAuth(auth authorization) error {
-	if len(auth.ClientToken) < 60 {
-		return fmt.Errorf("client token is too short (%d chars) want at least 60", len(auth.ClientToken))
+	tokens := auth.clientTokens()
+	if len(tokens) == 0 && len(auth.OIDCClaims) == 0 && !auth.hasClientCertBindings() {
+		return fmt.Errorf("client token is too short (0 chars) want at least 60")
+	}
+	for _, token := range tokens {
+		err := token.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if auth.RequireClientCert && !auth.hasClientCertBindings() {
+		return fmt.Errorf("auth requires a client certificate but isn't bound to any")
+	}
+	if auth.RequireClientCert && len(tokens) == 0 && len(auth.OIDCClaims) == 0 {
+		return fmt.Errorf("auth requires a client certificate in addition to a token but has no token")
+	}
+	for _, fp := range auth.ClientCertSPKISHA256 {
+		err := validateClientTokenHash(fp)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate SPKI sha256 %q", fp)
+		}
 	}
 	if auth.Signer == "" {
 		return fmt.Errorf("upstream autograph signer ID is empty")
@@ -236,7 +716,16 @@ func validateAuth(auth authorization) error {
 	if auth.Key == "" {
 		return fmt.Errorf("upstream autograph user key is empty")
 	}
-	return nil
+	if auth.AddonID != "" && (auth.APKPackageName != "" || auth.APKMinVersionCode != 0) {
+		return fmt.Errorf("auth cannot set both an add-on ID and an APK policy")
+	}
+	if auth.APKMinVersionCode < 0 {
+		return fmt.Errorf("APK minimum version code is negative (%d)", auth.APKMinVersionCode)
+	}
+	if auth.MaxInputBytes < 0 {
+		return fmt.Errorf("max input bytes is negative (%d)", auth.MaxInputBytes)
+	}
+	return validateLimits(auth)
 }
 
 // validateBaseURL checks that the upstream autograph URL is parseable
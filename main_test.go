@@ -10,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -17,6 +18,8 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.upstream = newUpstreamClient(conf)
+	conf.quotas, _ = loadQuotaStore("")
 	log.Printf("configuration: %+v\n", conf)
 	// run the tests and exit
 	r := m.Run()
@@ -51,6 +54,36 @@ func Test_authorize(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name: "expect hashed token testapp-android auth",
+			args: args{authHeader: "ef580f783acd84de9c5534e20ec88afb3984ae0667a6555f76841006b954f984"},
+			expectedAuth: authorization{
+				User:   "alice",
+				Signer: "testapp-android",
+			},
+			expectedErr: nil,
+		},
+		{
+			name:         "hashed token value is not a token",
+			args:         args{authHeader: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa"},
+			expectedAuth: authorization{},
+			expectedErr:  errInvalidToken,
+		},
+		{
+			name: "expect rotated token testapp-android auth",
+			args: args{authHeader: "5518d8762deb0e34d650b880ebebfe6cd7f8c623b727c8f5fe33ada154bfbd73"},
+			expectedAuth: authorization{
+				User:   "alice",
+				Signer: "testapp-android",
+			},
+			expectedErr: nil,
+		},
+		{
+			name:         "expired rotated token",
+			args:         args{authHeader: "5c5807737e563bfa2be56d6acd7f74cb2cdcabec4dfc9c120c2e8a03a7f92fd0"},
+			expectedAuth: authorization{},
+			expectedErr:  errTokenExpired,
+		},
 		{
 			name:         "empty auth header",
 			args:         args{authHeader: "c4180d2963fffdcd1cd5a1a343225288b964d8934"},
@@ -72,7 +105,7 @@ func Test_authorize(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotAuth, err := authorize(tt.args.authHeader)
+			gotAuth, err := authorize(tt.args.authHeader, nil)
 			if err != tt.expectedErr {
 				t.Errorf("authorize() error = %v, expectedErr %v", err, tt.expectedErr)
 			}
@@ -163,6 +196,87 @@ func Test_findDuplicateClientToken(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "unique hashed tokens",
+			args: args{
+				auths: []authorization{
+					authorization{
+						ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					},
+					authorization{
+						ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+						ClientTokenSalt:   "eea34e7e00da3ced",
+					},
+					authorization{
+						ClientTokenSHA256: "d6d8d9e23e67b471ac785ec5ad3ba473d6ddc01c89b231ecc4a510c66266f647",
+						ClientTokenSalt:   "eea34e7e00da3ced",
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate plaintext and unsalted hashed token",
+			args: args{
+				auths: []authorization{
+					authorization{
+						ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					},
+					authorization{
+						ClientTokenSHA256: "D6D8D9E23E67B471AC785EC5AD3BA473D6DDC01C89B231ECC4A510C66266F647",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate plaintext and salted hashed token",
+			args: args{
+				auths: []authorization{
+					authorization{
+						ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+						ClientTokenSalt:   "eea34e7e00da3ced",
+					},
+					authorization{
+						ClientToken: "ef580f783acd84de9c5534e20ec88afb3984ae0667a6555f76841006b954f984",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate hashed tokens",
+			args: args{
+				auths: []authorization{
+					authorization{
+						ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+						ClientTokenSalt:   "eea34e7e00da3ced",
+					},
+					authorization{
+						ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+						ClientTokenSalt:   "eea34e7e00da3ced",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate token in rotated tokens",
+			args: args{
+				auths: []authorization{
+					authorization{
+						ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					},
+					authorization{
+						ClientTokens: []clientToken{
+							{ClientToken: "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880"},
+							{ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -209,6 +323,69 @@ func Test_validateAuth(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid auth with APK policy",
+			args: args{
+				auth: authorization{
+					ClientToken:       "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					APKPackageName:    "org.mozilla.focus",
+					APKMinVersionCode: 13472157,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid auth with hashed client token",
+			args: args{
+				auth: authorization{
+					ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+					ClientTokenSalt:   "eea34e7e00da3ced",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid auth with rotated client tokens",
+			args: args{
+				auth: authorization{
+					ClientTokens: []clientToken{
+						{
+							ClientToken: "5c5807737e563bfa2be56d6acd7f74cb2cdcabec4dfc9c120c2e8a03a7f92fd0",
+							ExpiresAt:   time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+						},
+						{
+							ClientToken: "5518d8762deb0e34d650b880ebebfe6cd7f8c623b727c8f5fe33ada154bfbd73",
+							NotBefore:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+						},
+					},
+					Signer: "testapp-android",
+					User:   "alice",
+					Key:    "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid auth with OIDC claims and no client token",
+			args: args{
+				auth: authorization{
+					OIDCClaims: map[string]string{
+						"repository": "mozilla/addon",
+						"ref":        "refs/heads/main",
+					},
+					Signer: "extensions-ecdsa",
+					User:   "alice",
+					Key:    "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: false,
+		},
 		{
 			name: "invalid auth empty client token",
 			args: args{
@@ -269,6 +446,126 @@ func Test_validateAuth(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid auth with both add-on ID and APK policy",
+			args: args{
+				auth: authorization{
+					ClientToken:    "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:         "extensions-ecdsa",
+					User:           "alice",
+					Key:            "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:        "myaddon@allizom.org",
+					APKPackageName: "org.mozilla.focus",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth negative APK minimum version code",
+			args: args{
+				auth: authorization{
+					ClientToken:       "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					APKMinVersionCode: -1,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth negative max input bytes",
+			args: args{
+				auth: authorization{
+					ClientToken:   "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+					Signer:        "testapp-android",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					MaxInputBytes: -1,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth both client token and hashed client token",
+			args: args{
+				auth: authorization{
+					ClientToken:       "ef580f783acd84de9c5534e20ec88afb3984ae0667a6555f76841006b954f984",
+					ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200fa",
+					ClientTokenSalt:   "eea34e7e00da3ced",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth short hashed client token",
+			args: args{
+				auth: authorization{
+					ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth non hex hashed client token",
+			args: args{
+				auth: authorization{
+					ClientTokenSHA256: "3e400130a73bb2e047ddacc4698f9e0ee995e34b22088da068ca1cc0ee9200zz",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth salt with plaintext client token",
+			args: args{
+				auth: authorization{
+					ClientToken:     "ef580f783acd84de9c5534e20ec88afb3984ae0667a6555f76841006b954f984",
+					ClientTokenSalt: "eea34e7e00da3ced",
+					Signer:          "testapp-android",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth short rotated client token",
+			args: args{
+				auth: authorization{
+					ClientTokens: []clientToken{
+						{ClientToken: "5518d8762deb0e34d650b880ebebfe6cd7f8c623b727c8f5fe33ada154bfbd73"},
+						{ClientToken: "1234"},
+					},
+					Signer: "testapp-android",
+					User:   "alice",
+					Key:    "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth expires before not before",
+			args: args{
+				auth: authorization{
+					ClientToken: "5518d8762deb0e34d650b880ebebfe6cd7f8c623b727c8f5fe33ada154bfbd73",
+					NotBefore:   time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+					ExpiresAt:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+					Signer:      "testapp-android",
+					User:        "alice",
+					Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -347,6 +644,10 @@ func TestPrepareServerOptions(t *testing.T) {
 func Test_preparedServer(t *testing.T) {
 	// For the purpose of testing - ensure we're using IPv4.
 	conf.BaseURL = "http://127.0.0.1:8000/"
+	// start with a closed circuit breaker regardless of other tests
+	savedUpstream := conf.upstream
+	defer func() { conf.upstream = savedUpstream }()
+	conf.upstream = newUpstreamClient(conf)
 
 	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Hello, client")
@@ -439,7 +740,7 @@ func Test_preparedServer(t *testing.T) {
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: `{"status":false,"checks":{"check_autograph_heartbeat":false},"details":"failed to request autograph heartbeat from http://127.0.0.1:8000/__heartbeat__: Get \"http://127.0.0.1:8000/__heartbeat__\": dial tcp 127.0.0.1:8000: connect: connection refused"}`,
+			expectedBody: `{"status":false,"checks":{"check_autograph_heartbeat":false},"details":"failed to request autograph heartbeat from http://127.0.0.1:8000/__heartbeat__: Get \"http://127.0.0.1:8000/__heartbeat__\": dial tcp 127.0.0.1:8000: connect: connection refused","upstreams":[{"url":"http://127.0.0.1:8000/","healthy":false,"circuit_breaker":"closed"}]}`,
 		},
 		{
 			name:           "test GET /sign path method not allowed",
@@ -537,7 +838,7 @@ func Test_preparedServer(t *testing.T) {
 			expectedBody: "failed to read form data\n",
 		},
 		{
-			name:              "test POST /sign path valid auth header small input form field form encoded bad request",
+			name:              "test POST /sign path valid addon auth header invalid XPI bad request",
 			method:            "POST",
 			path:              "/sign",
 			authHeader:        "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
@@ -546,6 +847,29 @@ func Test_preparedServer(t *testing.T) {
 Content-Disposition: form-data; name="input"; filename="input"
 Content-Type: application/octet-stream
 
+;
+--fd8f34fd6a9c766e--
+`),
+			expectedStatus: http.StatusBadRequest,
+			expectedHeaders: http.Header{
+				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
+				"X-Frame-Options":           []string{"DENY"},
+				"X-Content-Type-Options":    []string{"nosniff"},
+				"Strict-Transport-Security": []string{"max-age=31536000;"},
+			},
+			expectedBody: "invalid XPI: failed to read zip archive: zip: not a valid zip file\n",
+		},
+		{
+			name:              "test POST /sign path valid auth header small input form field form encoded bad request",
+			method:            "POST",
+			path:              "/sign",
+			authHeader:        "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+			contentTypeHeader: "multipart/form-data; boundary=fd8f34fd6a9c766e",
+			body: []byte(`--fd8f34fd6a9c766e
+Content-Disposition: form-data; name="input"; filename="input"
+Content-Type: application/octet-stream
+
 ;
 --fd8f34fd6a9c766e--
 `),
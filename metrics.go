@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics exposed on /__metrics__
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	signRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autograph_edge_sign_requests_total",
+		Help: "Number of /sign requests by authorization user, signer and outcome.",
+	}, []string{"user", "signer", "outcome"})
+
+	signRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "autograph_edge_sign_request_duration_seconds",
+		Help:    "Duration of /sign requests by authorization user, signer and outcome.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"user", "signer", "outcome"})
+
+	signInputBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "autograph_edge_sign_input_bytes",
+		Help:    "Size of the files uploaded to /sign by authorization user and signer.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"user", "signer"})
+
+	upstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "autograph_edge_upstream_request_duration_seconds",
+		Help:    "Duration of autograph /sign/file requests by upstream and response status code, or error when no response was received.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"upstream", "code"})
+
+	signatureVerificationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autograph_edge_signature_verification_failures_total",
+		Help: "Number of files signed by autograph that failed verification by authorization user and signer.",
+	}, []string{"user", "signer"})
+
+	limitedSignRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autograph_edge_limited_sign_requests_total",
+		Help: "Number of /sign requests rejected by a rate limit or concurrency cap by authorization user, signer and limit.",
+	}, []string{"user", "signer", "limit"})
+
+	signingsInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "autograph_edge_signings_in_progress",
+		Help: "Number of /sign requests being handled by authorization user and signer.",
+	}, []string{"user", "signer"})
+
+	heartbeatChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autograph_edge_heartbeat_checks_total",
+		Help: "Number of /__heartbeat__ checks of the upstream autograph by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		signRequests,
+		signRequestDuration,
+		signInputBytes,
+		upstreamRequestDuration,
+		signatureVerificationFailures,
+		limitedSignRequests,
+		signingsInProgress,
+		heartbeatChecks,
+	)
+}
+
+// metricsHandler serves the metrics of metricsRegistry
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// prepareMetricsServer returns a server exposing /__metrics__ on its
+// own listener, so it doesn't have to be reachable by clients
+func prepareMetricsServer(host string, port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/__metrics__", metricsHandler())
+	return &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", host, port),
+		Handler: mux,
+	}
+}
+
+// signMetricLabels are the authorization labels of a /sign request,
+// set by sigHandler once the request is authorized
+type signMetricLabels struct {
+	user, signer string
+}
+
+var contextKeySignMetricLabels = contextKey{name: "signMetricLabels"}
+
+// setSignMetricLabels records the user and signer of the authorization
+// of a request for its metrics
+func setSignMetricLabels(r *http.Request, auth authorization) {
+	labels, ok := r.Context().Value(contextKeySignMetricLabels).(*signMetricLabels)
+	if ok {
+		labels.user = auth.User
+		labels.signer = auth.Signer
+	}
+}
+
+// statusRecorder is an http.ResponseWriter that keeps the status code
+// of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// signOutcome returns the outcome label of a /sign response status code
+func signOutcome(status int) string {
+	switch {
+	case status == http.StatusCreated:
+		return "signed"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return "throttled"
+	case status == http.StatusBadGateway:
+		return "upstream_error"
+	case status >= 400 && status < 500:
+		return "rejected"
+	default:
+		return "error"
+	}
+}
+
+// observeSignRequest is a middleware that counts and times /sign
+// requests by authorization and outcome
+func observeSignRequest() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			labels := &signMetricLabels{}
+			sr := &statusRecorder{ResponseWriter: w}
+			h.ServeHTTP(sr, addToContext(r, contextKeySignMetricLabels, labels))
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+
+			outcome := signOutcome(sr.status)
+			signRequests.WithLabelValues(labels.user, labels.signer, outcome).Inc()
+			signRequestDuration.WithLabelValues(labels.user, labels.signer, outcome).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// observeUpstreamRequest records the duration of an autograph request
+// to an upstream and its status code, or error when resp is nil
+func observeUpstreamRequest(upstream string, start time.Time, resp *http.Response) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamRequestDuration.WithLabelValues(upstream, code).Observe(time.Since(start).Seconds())
+}
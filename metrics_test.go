@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_signOutcome(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusCreated, "signed"},
+		{http.StatusUnauthorized, "unauthorized"},
+		{http.StatusBadRequest, "rejected"},
+		{http.StatusMethodNotAllowed, "rejected"},
+		{http.StatusBadGateway, "upstream_error"},
+		{http.StatusTooManyRequests, "throttled"},
+		{http.StatusServiceUnavailable, "throttled"},
+		{http.StatusInternalServerError, "error"},
+	}
+	for _, tt := range tests {
+		if got := signOutcome(tt.status); got != tt.expected {
+			t.Errorf("signOutcome(%d) = %q expected %q", tt.status, got, tt.expected)
+		}
+	}
+}
+
+func TestSignMetrics(t *testing.T) {
+	handler := handleWithMiddleware(
+		http.HandlerFunc(sigHandler),
+		setRequestID(),
+		observeSignRequest(),
+	)
+	before := testutil.ToFloat64(signRequests.WithLabelValues("", "", "unauthorized"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost:8080/sign", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("sigHandler returned %d expected %d", w.Code, http.StatusUnauthorized)
+	}
+	after := testutil.ToFloat64(signRequests.WithLabelValues("", "", "unauthorized"))
+	if after != before+1 {
+		t.Fatalf("unauthorized sign requests went from %v to %v expected an increment of 1", before, after)
+	}
+
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/__metrics__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metricsHandler returned %d expected %d", w.Code, http.StatusOK)
+	}
+	body, _ := io.ReadAll(w.Body)
+	for _, name := range []string{
+		`autograph_edge_sign_requests_total{outcome="unauthorized",signer="",user=""}`,
+		`autograph_edge_sign_request_duration_seconds_bucket`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("metrics do not contain %s", name)
+		}
+	}
+}
+
+func TestPrepareMetricsServer(t *testing.T) {
+	server := prepareMetricsServer("127.0.0.1", 9090)
+	if server.Addr != "127.0.0.1:9090" {
+		t.Fatalf("metrics server address %s expected 127.0.0.1:9090", server.Addr)
+	}
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:9090/sign", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("metrics server returned %d for /sign expected %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io"
 	"math/rand"
 	"net/http"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Middleware wraps an http.Handler with additional functionality
@@ -53,3 +56,53 @@ func setResponseHeaders() Middleware {
 		})
 	}
 }
+
+// limitRequestBody is a middleware that rejects requests with a body
+// larger than max bytes with a 413. Requests announcing a larger
+// Content-Length are rejected before reading their body, the others
+// fail to read past max bytes. Zero means no limit.
+func limitRequestBody(max int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if max <= 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			r.Body = &countingBody{ReadCloser: http.MaxBytesReader(w, r.Body, max)}
+			if r.ContentLength > max {
+				rejectBodyTooLarge(w, r, max)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// countingBody counts the bytes read from a request body, so the size
+// of bodies without a Content-Length can be logged
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// rejectBodyTooLarge logs the size of a request with a body larger than
+// max bytes, and how much of it was read, and rejects it with a 413
+func rejectBodyTooLarge(w http.ResponseWriter, r *http.Request, max int64) {
+	var read int64
+	if body, ok := r.Body.(*countingBody); ok {
+		read = body.read
+	}
+	log.WithFields(log.Fields{
+		"rid":            getRequestID(r),
+		"content_length": r.ContentLength,
+		"bytes_read":     read,
+		"max_body_bytes": max,
+	}).Error(errBodyTooLarge)
+	httpError(w, r, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "%s: the maximum is %d bytes", errBodyTooLarge, max)
+}
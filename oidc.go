@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 for crypto.SHA256.New
+	_ "crypto/sha512" // register SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwtLeeway is the clock skew tolerated when checking the
+	// exp, nbf and iat claims of identity tokens
+	jwtLeeway = time.Minute
+
+	// jwksMinRefreshInterval rate limits fetching the JWKS when
+	// tokens are signed with an unknown key ID
+	jwksMinRefreshInterval = time.Minute
+
+	// jwksMaxAge is how long keys fetched from the JWKS URL are used
+	// before fetching them again
+	jwksMaxAge = time.Hour
+
+	// maxJWKSSize is the largest JWKS document we'll read
+	maxJWKSSize = 1 << 20
+)
+
+// ecdsaCurveAlgorithms maps curves to the only JWS algorithm that
+// can be used with them
+var ecdsaCurveAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// oidcConfiguration configures authenticating CI jobs with OpenID
+// Connect identity tokens (e.g. GitHub Actions ones) instead of
+// client tokens. Keys are read from JWKSFile if set, otherwise they
+// are fetched from JWKSURL.
+type oidcConfiguration struct {
+	Issuer   string
+	Audience string
+	JWKSURL  string `yaml:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file"`
+
+	keys *jwksCache
+}
+
+// jwksCache holds the public keys used to verify identity tokens by
+// key ID
+type jwksCache struct {
+	sync.Mutex
+
+	url         string
+	client      *http.Client
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// jsonWebKey is the subset of RFC 7517 JSON Web Key fields needed to
+// load RSA and EC signature verification keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// validateOIDCConfiguration checks the OIDC configuration, loads its
+// keys, and returns an error if authorizations use OIDC claims while
+// OIDC isn't configured or if a token could match the OIDC claims of
+// more than one authorization
+func validateOIDCConfiguration(c *configuration) error {
+	if c.OIDC == nil {
+		for i, auth := range c.Authorizations {
+			if len(auth.OIDCClaims) > 0 {
+				return fmt.Errorf("auth %d has OIDC claims but OIDC is not configured", i)
+			}
+		}
+		return nil
+	}
+	for i, auth := range c.Authorizations {
+		for j := i + 1; j < len(c.Authorizations); j++ {
+			if auth.overlapsClaims(c.Authorizations[j]) {
+				return fmt.Errorf("auths %d and %d have overlapping OIDC claims: add a claim with different values to tell them apart", i, j)
+			}
+		}
+	}
+	return c.OIDC.init()
+}
+
+// overlapsClaims returns whether a token could match the OIDC claims
+// of both authorizations, that is when neither has a claim the other
+// requires with a different value
+func (auth authorization) overlapsClaims(other authorization) bool {
+	if len(auth.OIDCClaims) == 0 || len(other.OIDCClaims) == 0 {
+		return false
+	}
+	for name, value := range auth.OIDCClaims {
+		if otherValue, ok := other.OIDCClaims[name]; ok && otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// init validates the OIDC configuration and loads the JWKS from a
+// file or sets up fetching it from its URL
+func (o *oidcConfiguration) init() error {
+	if o.Issuer == "" {
+		return fmt.Errorf("OIDC issuer is empty")
+	}
+	if o.Audience == "" {
+		return fmt.Errorf("OIDC audience is empty")
+	}
+	switch {
+	case o.JWKSFile != "":
+		data, err := os.ReadFile(o.JWKSFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read OIDC JWKS file")
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse OIDC JWKS file %q", o.JWKSFile)
+		}
+		o.keys = &jwksCache{keys: keys}
+	case o.JWKSURL != "":
+		o.keys = &jwksCache{
+			url:    o.JWKSURL,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return fmt.Errorf("OIDC requires a jwks_url or jwks_file")
+	}
+	return nil
+}
+
+// parseJWKS returns the RSA and EC signature keys of a JWKS document
+// by key ID, skipping keys of other types or uses
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch jwk.Kty {
+		case "RSA":
+			key, err = jwk.rsaPublicKey()
+		case "EC":
+			key, err = jwk.ecdsaPublicKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q", jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (jwk jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeBase64URLInt(jwk.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid modulus")
+	}
+	e, err := decodeBase64URLInt(jwk.E)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid exponent")
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("unsupported exponent")
+	}
+	if n.BitLen() < 2048 {
+		return nil, fmt.Errorf("modulus is too short (%d bits) want at least 2048", n.BitLen())
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (jwk jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch jwk.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+	}
+	x, err := decodeBase64URLInt(jwk.X)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid x coordinate")
+	}
+	y, err := decodeBase64URLInt(jwk.Y)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid y coordinate")
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("point is not on curve %s", jwk.Crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// fetch replaces the cached keys with the ones from the JWKS URL.
+// The caller must hold the lock.
+func (c *jwksCache) fetch() error {
+	c.attemptedAt = time.Now()
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS URL returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	c.fetchedAt = c.attemptedAt
+	return nil
+}
+
+// key returns the public key with the given key ID, (re)fetching the
+// JWKS when the cached keys are stale or don't include the key ID.
+// Stale keys keep being used while fetching the JWKS fails, and
+// failed fetches are retried at most once a minute.
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	key, ok := c.keys[kid]
+	if c.url != "" && time.Since(c.attemptedAt) > jwksMinRefreshInterval && (!ok || time.Since(c.fetchedAt) > jwksMaxAge) {
+		err := c.fetch()
+		if err != nil && !ok {
+			return nil, errors.Wrap(err, "failed to fetch JWKS")
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"jwks_url":   c.url,
+				"fetched_at": c.fetchedAt,
+			}).Warnf("failed to refresh JWKS, using the cached keys: %s", err)
+			return key, nil
+		}
+		key, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+// isJWT returns whether an Authorization header value looks like a
+// (Bearer) JSON Web Token rather than a client token
+func isJWT(authHeader string) bool {
+	parts := strings.Split(strings.TrimPrefix(authHeader, "Bearer "), ".")
+	return len(parts) == 3 && strings.HasPrefix(parts[0], "eyJ")
+}
+
+// verifyJWTSignature checks the signature of the signing input with
+// the key and JWS algorithm
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q cannot be used with an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %q cannot be used with an EC key", alg)
+		}
+		if alg != ecdsaCurveAlgorithms[pub.Curve.Params().Name] {
+			return fmt.Errorf("algorithm %q cannot be used with curve %s", alg, pub.Curve.Params().Name)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length %d", len(sig))
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// numericDateClaim returns the time of a JWT NumericDate claim and
+// whether it was present
+func numericDateClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	val, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	num, ok := val.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %q is not a number", name)
+	}
+	secs, err := num.Float64()
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "invalid claim %q", name)
+	}
+	return time.Unix(int64(secs), 0), true, nil
+}
+
+// hasAudience returns whether the aud claim, a string or array of
+// strings, contains the audience
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks the signature, issuer, audience and validity period
+// of an identity token and returns its claims
+func (o *oidcConfiguration) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(strings.TrimPrefix(token, "Bearer "), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token does not have three parts")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode header")
+	}
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode signature")
+	}
+	key, err := o.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify signature")
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode claims")
+	}
+	var claims map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(rawClaims))
+	dec.UseNumber()
+	err = dec.Decode(&claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse claims")
+	}
+	if claims["iss"] != o.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims["iss"])
+	}
+	if !hasAudience(claims, o.Audience) {
+		return nil, fmt.Errorf("unexpected audience %q", claims["aud"])
+	}
+	exp, ok, err := numericDateClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("token has no expiration")
+	}
+	if !now.Before(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	for _, name := range []string{"nbf", "iat"} {
+		t, ok, err := numericDateClaim(claims, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && now.Add(jwtLeeway).Before(t) {
+			return nil, fmt.Errorf("token %s claim %s is in the future", name, t.UTC().Format(time.RFC3339))
+		}
+	}
+	return claims, nil
+}
+
+// matchesClaims returns whether every OIDC claim of the authorization
+// is a string claim of the token with the same value
+func (auth authorization) matchesClaims(claims map[string]interface{}) bool {
+	if len(auth.OIDCClaims) == 0 {
+		return false
+	}
+	for name, expected := range auth.OIDCClaims {
+		if val, ok := claims[name].(string); !ok || val != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyOIDC verifies an identity token with the OIDC configuration
+// and returns its claims. It can fetch the JWKS, so it must be called
+// without holding confMu.
+func verifyOIDC(oidc *oidcConfiguration, token string) (map[string]interface{}, error) {
+	claims, err := oidc.verify(token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidOIDCToken, err)
+	}
+	return claims, nil
+}
+
+// authorizeOIDC returns the authorization whose OIDC claims all match
+// the claims of a verified identity token. validateOIDCConfiguration
+// ensures at most one does.
+func authorizeOIDC(claims map[string]interface{}) (authorization, error) {
+	for _, auth := range conf.Authorizations {
+		if auth.matchesClaims(claims) {
+			return auth, nil
+		}
+	}
+	return authorization{}, fmt.Errorf("%w: sub %q", errNoOIDCAuthorization, claims["sub"])
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeTestJWT returns a JWT with the claims signed by the RSA or
+// ECDSA P-256 key
+func makeTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// makeTestJWKS returns a JWKS document with the public keys of the
+// RSA and ECDSA keys
+func makeTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa-key",
+				"use": "sig",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-key",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+			{
+				"kty": "oct",
+				"kid": "symmetric-key",
+				"k":   "c2VjcmV0",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwks
+}
+
+func TestOIDC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksFile, makeTestJWKS(t, rsaKey, ecKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.OIDC = &oidcConfiguration{
+		Issuer:   "https://token.actions.githubusercontent.com",
+		Audience: "autograph-edge",
+		JWKSFile: jwksFile,
+	}
+	conf.Authorizations = append(conf.Authorizations[:len(conf.Authorizations):len(conf.Authorizations)],
+		authorization{
+			OIDCClaims: map[string]string{
+				"repository": "mozilla/addon",
+				"ref":        "refs/heads/main",
+				"workflow":   "release",
+			},
+			User:    "alice",
+			Signer:  "extensions-ecdsa",
+			AddonID: "oidc@allizom.org",
+		},
+	)
+	err = validateOIDCConfiguration(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":        "https://token.actions.githubusercontent.com",
+			"aud":        "autograph-edge",
+			"sub":        "repo:mozilla/addon:ref:refs/heads/main",
+			"exp":        now.Add(5 * time.Minute).Unix(),
+			"iat":        now.Unix(),
+			"nbf":        now.Unix(),
+			"repository": "mozilla/addon",
+			"ref":        "refs/heads/main",
+			"workflow":   "release",
+		}
+	}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name            string
+		authHeader      string
+		expectedAddonID string
+		expectedErr     error
+	}{
+		{
+			name:            "RSA signed token",
+			authHeader:      makeTestJWT(t, rsaKey, "rsa-key", validClaims()),
+			expectedAddonID: "oidc@allizom.org",
+		},
+		{
+			name:            "ECDSA signed bearer token",
+			authHeader:      "Bearer " + makeTestJWT(t, ecKey, "ec-key", validClaims()),
+			expectedAddonID: "oidc@allizom.org",
+		},
+		{
+			name:            "audience array",
+			authHeader:      makeTestJWT(t, ecKey, "ec-key", withClaim("aud", []string{"other", "autograph-edge"})),
+			expectedAddonID: "oidc@allizom.org",
+		},
+		{
+			name:            "client tokens still work",
+			authHeader:      "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			expectedAddonID: "myaddon@allizom.org",
+		},
+		{
+			name:        "signed by unknown key",
+			authHeader:  makeTestJWT(t, otherKey, "other-key", validClaims()),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "signed by wrong key",
+			authHeader:  makeTestJWT(t, otherKey, "ec-key", validClaims()),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "algorithm mismatch",
+			authHeader:  makeTestJWT(t, ecKey, "rsa-key", validClaims()),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "wrong issuer",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("iss", "https://example.com")),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "wrong audience",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("aud", "other")),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "expired",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("exp", now.Add(-2*jwtLeeway).Unix())),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "no expiration",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("exp", nil)),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "not valid yet",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("nbf", now.Add(2*jwtLeeway).Unix())),
+			expectedErr: errInvalidOIDCToken,
+		},
+		{
+			name:        "other ref",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("ref", "refs/heads/feature")),
+			expectedErr: errNoOIDCAuthorization,
+		},
+		{
+			name:        "missing workflow",
+			authHeader:  makeTestJWT(t, ecKey, "ec-key", withClaim("workflow", nil)),
+			expectedErr: errNoOIDCAuthorization,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := authorize(tt.authHeader, nil)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("authorize() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if auth.AddonID != tt.expectedAddonID {
+				t.Fatalf("authorize() auth.AddonID got %q expected %q", auth.AddonID, tt.expectedAddonID)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheFetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	failing := false
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(makeTestJWKS(t, rsaKey, ecKey))
+	}))
+	defer jwksServer.Close()
+
+	oidc := &oidcConfiguration{
+		Issuer:   "https://token.actions.githubusercontent.com",
+		Audience: "autograph-edge",
+		JWKSURL:  jwksServer.URL,
+	}
+	err = oidc.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oidc.keys.key("ec-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oidc.keys.key("rsa-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown keys don't refetch the JWKS more than once a minute
+	_, err = oidc.keys.key("unknown-key")
+	if err == nil {
+		t.Fatal("expected an error for an unknown key ID")
+	}
+	if fetches != 1 {
+		t.Fatalf("fetched JWKS %d times expected 1", fetches)
+	}
+
+	// stale keys are used while refreshing the JWKS fails
+	failing = true
+	oidc.keys.fetchedAt = time.Now().Add(-2 * jwksMaxAge)
+	oidc.keys.attemptedAt = oidc.keys.fetchedAt
+	_, err = oidc.keys.key("ec-key")
+	if err != nil {
+		t.Fatalf("key() with a failing refresh error = %v expected the cached key", err)
+	}
+	_, err = oidc.keys.key("rsa-key")
+	if err != nil {
+		t.Fatalf("key() with a failing refresh error = %v expected the cached key", err)
+	}
+	if fetches != 2 {
+		t.Fatalf("fetched JWKS %d times expected failed refreshes to be retried at most once a minute", fetches)
+	}
+	_, err = oidc.keys.key("unknown-key")
+	if err == nil {
+		t.Fatal("expected an error for an unknown key ID")
+	}
+
+	// and replaced once it succeeds again
+	failing = false
+	oidc.keys.attemptedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	_, err = oidc.keys.key("ec-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 3 || time.Since(oidc.keys.fetchedAt) > time.Minute {
+		t.Fatalf("fetched JWKS %d times at %s expected a successful refresh", fetches, oidc.keys.fetchedAt)
+	}
+}
+
+func TestAuthorizeOIDCFetchesWithoutConfLock(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the JWKS server takes the configuration write lock like a
+	// reload, which deadlocks if the fetch holds the read lock
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locked := make(chan struct{})
+		go func() {
+			confMu.Lock()
+			confMu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Error("fetching the JWKS held the configuration lock")
+		}
+		w.Write(makeTestJWKS(t, rsaKey, ecKey))
+	}))
+	defer jwksServer.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.OIDC = &oidcConfiguration{
+		Issuer:   "https://token.actions.githubusercontent.com",
+		Audience: "autograph-edge",
+		JWKSURL:  jwksServer.URL,
+	}
+	conf.Authorizations = []authorization{
+		{
+			OIDCClaims: map[string]string{"repository": "mozilla/addon"},
+			User:       "alice",
+			Signer:     "extensions-ecdsa",
+			AddonID:    "oidc@allizom.org",
+		},
+	}
+	err = validateOIDCConfiguration(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token := makeTestJWT(t, ecKey, "ec-key", map[string]interface{}{
+		"iss":        "https://token.actions.githubusercontent.com",
+		"aud":        "autograph-edge",
+		"sub":        "repo:mozilla/addon:ref:refs/heads/main",
+		"exp":        now.Add(5 * time.Minute).Unix(),
+		"repository": "mozilla/addon",
+	})
+	auth, err := authorize(token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.AddonID != "oidc@allizom.org" {
+		t.Fatalf("authorize() auth.AddonID got %q expected %q", auth.AddonID, "oidc@allizom.org")
+	}
+}
+
+func Test_validateOIDCConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    configuration
+		wantErr bool
+	}{
+		{
+			name:    "no OIDC",
+			conf:    configuration{},
+			wantErr: false,
+		},
+		{
+			name: "OIDC claims without OIDC",
+			conf: configuration{
+				Authorizations: []authorization{
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing issuer",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing audience",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", JWKSURL: "https://example.com/jwks"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing JWKS",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing JWKS file",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSFile: "/does/not/exist"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "JWKS URL",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "distinct OIDC claims",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+				Authorizations: []authorization{
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon", "ref": "refs/heads/main"}},
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon", "ref": "refs/heads/release"}},
+					{ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "same OIDC claims",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+				Authorizations: []authorization{
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon"}},
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "OIDC claims subset",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+				Authorizations: []authorization{
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon"}},
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon", "ref": "refs/heads/main"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "OIDC claims on different names",
+			conf: configuration{
+				OIDC: &oidcConfiguration{Issuer: "https://example.com", Audience: "autograph-edge", JWKSURL: "https://example.com/jwks"},
+				Authorizations: []authorization{
+					{OIDCClaims: map[string]string{"repository": "mozilla/addon"}},
+					{OIDCClaims: map[string]string{"workflow": "release"}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateOIDCConfiguration(&tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("validateOIDCConfiguration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// quotaUsage is the number of files an authorization signed in a UTC
+// day and month
+type quotaUsage struct {
+	Day     string `json:"day"`
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int    `json:"monthly"`
+}
+
+// quotaStore counts the files signed by authorizations, saving the
+// counts to a file if it has a path so quotas survive restarts
+type quotaStore struct {
+	mu     sync.Mutex
+	path   string
+	counts map[string]*quotaUsage
+}
+
+// loadQuotaStore returns a quota store saved to path, with the counts
+// it contains if it exists. An empty path keeps the counts in memory.
+func loadQuotaStore(path string) (*quotaStore, error) {
+	s := &quotaStore{path: path, counts: make(map[string]*quotaUsage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// fail now rather than on the first signing if the file
+		// can't be created
+		return s, s.save(time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.counts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse quota file %q: %w", path, err)
+	}
+	return s, nil
+}
+
+// quotaPeriods returns the UTC day and month of a time
+func quotaPeriods(now time.Time) (day, month string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01")
+}
+
+// current returns the usage of an authorization in the day and month
+// of now. Callers must hold s.mu.
+func (s *quotaStore) current(auth authorization, now time.Time) quotaUsage {
+	day, month := quotaPeriods(now)
+	u := quotaUsage{Day: day, Month: month}
+	if saved, ok := s.counts[auth.identity()]; ok {
+		if saved.Day == day {
+			u.Daily = saved.Daily
+		}
+		if saved.Month == month {
+			u.Monthly = saved.Monthly
+		}
+	}
+	return u
+}
+
+// save writes the counts to the file of the store, replacing it
+// atomically, and drops those of months before now. Callers must hold
+// s.mu.
+func (s *quotaStore) save(now time.Time) error {
+	if s.path == "" {
+		return nil
+	}
+	_, month := quotaPeriods(now)
+	for key, u := range s.counts {
+		// counts of past months can't be used anymore
+		if u.Month < month {
+			delete(s.counts, key)
+		}
+	}
+	data, err := json.Marshal(s.counts)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// reserve counts a signing against the quotas of an authorization. It
+// returns a function to call if the signing fails to give it back, or
+// an error and how long until the exhausted quota resets. Signings of
+// authorizations without quotas aren't counted.
+func (s *quotaStore) reserve(auth authorization, now time.Time) (refund func(), retryAfter time.Duration, err error) {
+	if auth.DailyQuota == 0 && auth.MonthlyQuota == 0 {
+		return func() {}, 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := auth.identity()
+	previous, hadPrevious := s.counts[key]
+	u := s.current(auth, now)
+	if auth.DailyQuota > 0 && u.Daily >= auth.DailyQuota {
+		return nil, nextDay(now).Sub(now), fmt.Errorf("%w: %d signings per day", errQuotaExceeded, auth.DailyQuota)
+	}
+	if auth.MonthlyQuota > 0 && u.Monthly >= auth.MonthlyQuota {
+		return nil, nextMonth(now).Sub(now), fmt.Errorf("%w: %d signings per month", errQuotaExceeded, auth.MonthlyQuota)
+	}
+	u.Daily++
+	u.Monthly++
+	s.counts[key] = &u
+	err = s.save(now)
+	if err != nil {
+		if hadPrevious {
+			s.counts[key] = previous
+		} else {
+			delete(s.counts, key)
+		}
+		return nil, 0, fmt.Errorf("failed to save quota usage: %w", err)
+	}
+
+	day, month := u.Day, u.Month
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// the periods may have ended since, the signing is
+			// only given back to the ones it was counted in
+			u, ok := s.counts[key]
+			if !ok {
+				return
+			}
+			changed := false
+			if u.Day == day && u.Daily > 0 {
+				u.Daily--
+				changed = true
+			}
+			if u.Month == month && u.Monthly > 0 {
+				u.Monthly--
+				changed = true
+			}
+			if !changed {
+				return
+			}
+			err := s.save(now)
+			if err != nil {
+				log.Errorf("failed to save quota usage: %s", err)
+			}
+		})
+	}, 0, nil
+}
+
+// quotaUsageResponse is the usage of a quota returned by usageHandler.
+// A zero Quota means there is none.
+type quotaUsageResponse struct {
+	Used     int       `json:"used"`
+	Quota    int       `json:"quota"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+type usageResponse struct {
+	User    string             `json:"user"`
+	Signer  string             `json:"signer"`
+	Daily   quotaUsageResponse `json:"daily"`
+	Monthly quotaUsageResponse `json:"monthly"`
+}
+
+// usage returns the usage of the quotas of an authorization
+func (s *quotaStore) usage(auth authorization, now time.Time) usageResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.current(auth, now)
+	return usageResponse{
+		User:    auth.User,
+		Signer:  auth.Signer,
+		Daily:   quotaUsageResponse{Used: u.Daily, Quota: auth.DailyQuota, ResetsAt: nextDay(now)},
+		Monthly: quotaUsageResponse{Used: u.Monthly, Quota: auth.MonthlyQuota, ResetsAt: nextMonth(now)},
+	}
+}
+
+// nextDay returns the start of the UTC day after now
+func nextDay(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// nextMonth returns the start of the UTC month after now
+func nextMonth(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// validateQuotas checks the quotas of the authorizations, which must be
+// saved to a quota file to survive restarts
+func validateQuotas(c *configuration) error {
+	for i, auth := range c.Authorizations {
+		if auth.DailyQuota < 0 || auth.MonthlyQuota < 0 {
+			return fmt.Errorf("auth %d has a negative quota", i)
+		}
+		if (auth.DailyQuota > 0 || auth.MonthlyQuota > 0) && c.QuotaFile == "" {
+			return fmt.Errorf("auth %d has a quota but quota_file is not set", i)
+		}
+	}
+	return nil
+}
+
+// usageHandler returns the usage of the quotas of the authorization of
+// the request
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, http.StatusMethodNotAllowed, codeInvalidMethod, "invalid method")
+		return
+	}
+	auth, ok := authorizeRequest(w, r)
+	if !ok || !allowClientIP(w, r, auth) {
+		return
+	}
+	usage, err := json.Marshal(conf.quotas.usage(auth, time.Now()))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, codeInternalError, "failed to encode usage")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(usage)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	s, err := loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := conf.Authorizations[2]
+	auth.DailyQuota = 2
+	auth.MonthlyQuota = 3
+	now := time.Date(2026, time.October, 30, 18, 0, 0, 0, time.UTC)
+
+	_, _, err = s.reserve(auth, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, _, err := s.reserve(auth, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, retryAfter, err := s.reserve(auth, now)
+	if !errors.Is(err, errQuotaExceeded) || retryAfter != 6*time.Hour {
+		t.Fatalf("reserve() over the daily quota = %s, %v expected 6h, %v", retryAfter, err, errQuotaExceeded)
+	}
+	// refunding twice gives a single signing back
+	refund()
+	refund()
+	refund, _, err = s.reserve(auth, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.reserve(auth, now)
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("reserve() error = %v expected %v", err, errQuotaExceeded)
+	}
+	// other authorizations have their own counts
+	_, _, err = s.reserve(conf.Authorizations[0], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the daily count resets the next day, but not the monthly one
+	tomorrow := now.Add(24 * time.Hour)
+	_, _, err = s.reserve(auth, tomorrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, retryAfter, err = s.reserve(auth, tomorrow)
+	if !errors.Is(err, errQuotaExceeded) || retryAfter != 6*time.Hour {
+		t.Fatalf("reserve() over the monthly quota = %s, %v expected 6h, %v", retryAfter, err, errQuotaExceeded)
+	}
+	// refunds of a past day are only given back to the month
+	refund()
+
+	// the counts survive restarts
+	s, err = loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := s.usage(auth, tomorrow)
+	expected := usageResponse{
+		User:    auth.User,
+		Signer:  auth.Signer,
+		Daily:   quotaUsageResponse{Used: 1, Quota: 2, ResetsAt: time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		Monthly: quotaUsageResponse{Used: 2, Quota: 3, ResetsAt: time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if usage != expected {
+		t.Fatalf("usage() = %+v expected %+v", usage, expected)
+	}
+
+	// counts of past months are dropped from the file
+	_, _, err = s.reserve(auth, tomorrow.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]quotaUsage
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[auth.identity()].Month != "2026-11" {
+		t.Fatalf("quota file contains %s expected the count of a single authorization in 2026-11", data)
+	}
+}
+
+func TestQuotaStoreIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	s, err := loadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// signings of authorizations without quotas aren't counted or saved
+	_, _, err = s.reserve(conf.Authorizations[2], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.counts) != 0 || string(data) != "{}" {
+		t.Fatalf("reserve() without quotas counted %s", data)
+	}
+
+	// rotating the credentials of an authorization keeps its counts
+	auth := conf.Authorizations[2]
+	auth.DailyQuota = 1
+	_, _, err = s.reserve(auth, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ClientTokens = []clientToken{{ClientToken: conf.Authorizations[0].ClientToken}}
+	_, _, err = s.reserve(auth, now)
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("reserve() after a token rotation error = %v expected %v", err, errQuotaExceeded)
+	}
+}
+
+func Test_validateQuotas(t *testing.T) {
+	dir := t.TempDir()
+	invalidFile := filepath.Join(dir, "invalid.json")
+	err := os.WriteFile(invalidFile, []byte("not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withQuota := []authorization{{DailyQuota: 10}}
+	tests := []struct {
+		name    string
+		conf    configuration
+		wantErr bool
+	}{
+		{"no quotas", configuration{Authorizations: []authorization{{}}}, false},
+		{"quotas with a quota file", configuration{Authorizations: withQuota, QuotaFile: filepath.Join(dir, "quotas.json")}, false},
+		{"quotas without a quota file", configuration{Authorizations: withQuota}, true},
+		{"negative quota", configuration{Authorizations: []authorization{{MonthlyQuota: -1}}}, true},
+		{"invalid quota file", configuration{Authorizations: withQuota, QuotaFile: invalidFile}, true},
+		{"quota file in a missing directory", configuration{Authorizations: withQuota, QuotaFile: filepath.Join(dir, "missing", "quotas.json")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateQuotas(&tt.conf)
+			if err == nil {
+				tt.conf.quotas, err = loadQuotaStore(tt.conf.QuotaFile)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateQuotas() and loadQuotaStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.conf.quotas == nil {
+				t.Fatal("loadQuotaStore() did not return a quota store")
+			}
+		})
+	}
+}
+
+func TestSigHandlerQuotas(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+	failingAutograph := newTestAutograph(t, auth, testAutographResponse{tamperedBody: true})
+	defer failingAutograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.quotas, _ = loadQuotaStore("")
+	conf.Authorizations = append([]authorization{}, savedConf.Authorizations...)
+	conf.Authorizations[2].DailyQuota = 1
+
+	for i, tt := range []struct {
+		autograph    *httptest.Server
+		expectedCode int
+	}{
+		// failed signings don't count against the quota
+		{failingAutograph, http.StatusBadGateway},
+		{autograph, http.StatusCreated},
+		{autograph, http.StatusTooManyRequests},
+	} {
+		conf.BaseURL = tt.autograph.URL + "/"
+		conf.upstream = newUpstreamClient(conf)
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("input", "app.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("unsigned"))
+		mw.Close()
+		r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", auth.ClientToken)
+		w := httptest.NewRecorder()
+		sigHandler(w, r)
+		if w.Code != tt.expectedCode {
+			t.Fatalf("request %d returned %d expected %d", i, w.Code, tt.expectedCode)
+		}
+		if tt.expectedCode == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Fatalf("request %d over the quota did not return a Retry-After", i)
+		}
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.quotas, _ = loadQuotaStore("")
+	conf.Authorizations = append([]authorization{}, savedConf.Authorizations...)
+	conf.Authorizations[2].DailyQuota = 5
+	auth := conf.Authorizations[2]
+	_, _, err := conf.quotas.reserve(auth, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		token        string
+		expectedCode int
+	}{
+		{"usage", "GET", auth.ClientToken, http.StatusOK},
+		{"missing authorization", "GET", "", http.StatusUnauthorized},
+		{"invalid token", "GET", "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8548", http.StatusUnauthorized},
+		{"invalid method", "POST", auth.ClientToken, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://localhost:8080/usage", nil)
+			r.Header.Set("Authorization", tt.token)
+			w := httptest.NewRecorder()
+			usageHandler(w, r)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("usageHandler returned %d expected %d", w.Code, tt.expectedCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("usageHandler returned content type %q expected application/json", w.Header().Get("Content-Type"))
+			}
+			var usage usageResponse
+			err := json.Unmarshal(w.Body.Bytes(), &usage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.User != auth.User || usage.Signer != auth.Signer ||
+				usage.Daily.Used != 1 || usage.Daily.Quota != 5 || usage.Monthly.Used != 1 || usage.Monthly.Quota != 0 {
+				t.Fatalf("usageHandler returned %+v", usage)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst requests, refilled at rate
+// requests per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take removes a token from the bucket if there is one, otherwise it
+// returns how long until there is
+func (b *tokenBucket) take(now time.Time) (ok bool, retryAfter time.Duration) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// authLimits are the rate limit and concurrency cap state of an
+// authorization
+type authLimits struct {
+	rateLimitPerMinute    float64
+	rateLimitBurst        int
+	maxConcurrentSignings int
+
+	bucket   *tokenBucket
+	inFlight int
+}
+
+// signingLimiter enforces the rate limits and concurrency caps of the
+// authorizations, and the global concurrency cap
+type signingLimiter struct {
+	mu       sync.Mutex
+	byAuth   map[string]*authLimits
+	inFlight int
+}
+
+func newSigningLimiter() *signingLimiter {
+	return &signingLimiter{byAuth: make(map[string]*authLimits)}
+}
+
+// signingLimits is the limiter of /sign requests
+var signingLimits = newSigningLimiter()
+
+// rateLimitBurst returns the burst of the rate limit of an
+// authorization, which defaults to a minute worth of requests
+func (auth authorization) rateLimitBurst() int {
+	if auth.RateLimitBurst > 0 {
+		return auth.RateLimitBurst
+	}
+	return int(math.Max(1, math.Ceil(auth.RateLimitPerMinute)))
+}
+
+// identity identifies the limits and quotas of an authorization across
+// configuration reloads, so they aren't reset when its credentials are
+// rotated
+func (auth authorization) identity() string {
+	if auth.ID != "" {
+		return "id " + auth.ID
+	}
+	return fmt.Sprintf("user %q signer %q", auth.User, auth.Signer)
+}
+
+// hasLimits returns whether an authorization has rate limits,
+// concurrency caps or quotas
+func (auth authorization) hasLimits() bool {
+	return auth.RateLimitPerMinute > 0 || auth.MaxConcurrentSignings > 0 ||
+		auth.DailyQuota > 0 || auth.MonthlyQuota > 0
+}
+
+// validateIdentities checks that authorizations with limits or quotas
+// don't share their identity with another authorization, which would
+// share their state
+func validateIdentities(auths []authorization) error {
+	first := make(map[string]int)
+	for i, auth := range auths {
+		j, dup := first[auth.identity()]
+		if !dup {
+			first[auth.identity()] = i
+			continue
+		}
+		if auth.hasLimits() || auths[j].hasLimits() {
+			return fmt.Errorf("auths %d and %d both have the %s and one has limits or quotas, set an id to tell them apart", j, i, auth.identity())
+		}
+	}
+	return nil
+}
+
+// limits returns the state of the limits of an authorization, resetting
+// it when they were reconfigured. Callers must hold l.mu.
+func (l *signingLimiter) limits(auth authorization, now time.Time) *authLimits {
+	key := auth.identity()
+	al, ok := l.byAuth[key]
+	if ok && al.rateLimitPerMinute == auth.RateLimitPerMinute &&
+		al.rateLimitBurst == auth.rateLimitBurst() &&
+		al.maxConcurrentSignings == auth.MaxConcurrentSignings {
+		return al
+	}
+	next := &authLimits{
+		rateLimitPerMinute:    auth.RateLimitPerMinute,
+		rateLimitBurst:        auth.rateLimitBurst(),
+		maxConcurrentSignings: auth.MaxConcurrentSignings,
+	}
+	if auth.RateLimitPerMinute > 0 {
+		next.bucket = newTokenBucket(auth.RateLimitPerMinute/60, next.rateLimitBurst, now)
+	}
+	if ok {
+		// signings in progress still count against the new cap
+		next.inFlight = al.inFlight
+	}
+	l.byAuth[key] = next
+	return next
+}
+
+// acquire checks that a signing request of an authorization is within
+// its rate limit and concurrency cap, and within maxConcurrent
+// signings overall unless it's zero. It returns a function to call
+// once the signing is done, or an error and how long to wait before
+// retrying.
+func (l *signingLimiter) acquire(auth authorization, maxConcurrent int, now time.Time) (release func(), retryAfter time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	al := l.limits(auth, now)
+	if al.maxConcurrentSignings > 0 && al.inFlight >= al.maxConcurrentSignings {
+		return nil, time.Second, fmt.Errorf("%w: %d signings in progress", errTooManyConcurrentSignings, al.inFlight)
+	}
+	if maxConcurrent > 0 && l.inFlight >= maxConcurrent {
+		return nil, time.Second, errAtCapacity
+	}
+	if al.bucket != nil {
+		ok, retryAfter := al.bucket.take(now)
+		if !ok {
+			return nil, retryAfter, fmt.Errorf("%w: %g requests per minute", errRateLimited, al.rateLimitPerMinute)
+		}
+	}
+	al.inFlight++
+	l.inFlight++
+	signingsInProgress.WithLabelValues(auth.User, auth.Signer).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			// the limits may have been reconfigured since, the
+			// signings in progress were carried over
+			if al, ok := l.byAuth[auth.identity()]; ok && al.inFlight > 0 {
+				al.inFlight--
+			}
+			l.inFlight--
+			signingsInProgress.WithLabelValues(auth.User, auth.Signer).Dec()
+		})
+	}, 0, nil
+}
+
+// prune drops the state of the limits of authorizations that were
+// removed or changed identity, once the configuration is reloaded
+func (l *signingLimiter) prune(auths []authorization) {
+	current := make(map[string]bool)
+	for _, auth := range auths {
+		current[auth.identity()] = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, al := range l.byAuth {
+		// state with signings in progress is kept for their release
+		if !current[key] && al.inFlight == 0 {
+			delete(l.byAuth, key)
+		}
+	}
+}
+
+// limitLabel returns the metric label of the limit an error of acquire
+// or quotaStore.reserve is about
+func limitLabel(err error) string {
+	switch {
+	case errors.Is(err, errRateLimited):
+		return "rate"
+	case errors.Is(err, errTooManyConcurrentSignings):
+		return "concurrency"
+	case errors.Is(err, errQuotaExceeded):
+		return "quota"
+	default:
+		return "global_concurrency"
+	}
+}
+
+// validateLimits checks the rate limit and concurrency cap settings of
+// an authorization
+func validateLimits(auth authorization) error {
+	if auth.RateLimitPerMinute < 0 || math.IsNaN(auth.RateLimitPerMinute) || math.IsInf(auth.RateLimitPerMinute, 0) {
+		return fmt.Errorf("rate limit per minute is invalid (%g)", auth.RateLimitPerMinute)
+	}
+	if auth.RateLimitBurst < 0 {
+		return fmt.Errorf("rate limit burst is negative (%d)", auth.RateLimitBurst)
+	}
+	if auth.RateLimitBurst > 0 && auth.RateLimitPerMinute == 0 {
+		return fmt.Errorf("rate limit burst is set without a rate limit")
+	}
+	if auth.MaxConcurrentSignings < 0 {
+		return fmt.Errorf("max concurrent signings is negative (%d)", auth.MaxConcurrentSignings)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	// 2 requests per second with bursts of 3
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("request %d of the burst was limited", i)
+		}
+	}
+	ok, retryAfter := b.take(now)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("take() after the burst = %v, %s expected false, 500ms", ok, retryAfter)
+	}
+	ok, retryAfter = b.take(now.Add(250 * time.Millisecond))
+	if ok || retryAfter != 250*time.Millisecond {
+		t.Fatalf("take() after 250ms = %v, %s expected false, 250ms", ok, retryAfter)
+	}
+	if ok, _ = b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatal("take() after refilling a token was limited")
+	}
+	// the bucket doesn't fill past the burst
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now.Add(time.Hour)); !ok {
+			t.Fatalf("request %d of the burst after an hour was limited", i)
+		}
+	}
+	if ok, _ = b.take(now.Add(time.Hour)); ok {
+		t.Fatal("take() past the burst after an hour was not limited")
+	}
+}
+
+func TestSigningLimiter(t *testing.T) {
+	now := time.Now()
+	auth := authorization{ClientToken: "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd", User: "alice", Signer: "testapp-android"}
+	other := authorization{ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", User: "alice", Signer: "extensions-ecdsa"}
+
+	t.Run("concurrency cap", func(t *testing.T) {
+		l := newSigningLimiter()
+		auth := auth
+		auth.MaxConcurrentSignings = 2
+		release1, _, err := l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, retryAfter, err := l.acquire(auth, 0, now)
+		if !errors.Is(err, errTooManyConcurrentSignings) || retryAfter != time.Second {
+			t.Fatalf("acquire() = %s, %v expected 1s, %v", retryAfter, err, errTooManyConcurrentSignings)
+		}
+		if limitLabel(err) != "concurrency" {
+			t.Fatalf("limitLabel() = %q expected concurrency", limitLabel(err))
+		}
+		// other authorizations aren't affected
+		_, _, err = l.acquire(other, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// releasing twice frees a single slot
+		release1()
+		release1()
+		_, _, err = l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = l.acquire(auth, 0, now)
+		if !errors.Is(err, errTooManyConcurrentSignings) {
+			t.Fatalf("acquire() error = %v expected %v", err, errTooManyConcurrentSignings)
+		}
+		// raising the cap keeps the signings in progress
+		auth.MaxConcurrentSignings = 3
+		_, _, err = l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = l.acquire(auth, 0, now)
+		if !errors.Is(err, errTooManyConcurrentSignings) {
+			t.Fatalf("acquire() error = %v expected %v", err, errTooManyConcurrentSignings)
+		}
+	})
+
+	t.Run("global concurrency cap", func(t *testing.T) {
+		l := newSigningLimiter()
+		release, _, err := l.acquire(auth, 1, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = l.acquire(other, 1, now)
+		if err != errAtCapacity {
+			t.Fatalf("acquire() error = %v expected %v", err, errAtCapacity)
+		}
+		if limitLabel(err) != "global_concurrency" {
+			t.Fatalf("limitLabel() = %q expected global_concurrency", limitLabel(err))
+		}
+		release()
+		_, _, err = l.acquire(other, 1, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		l := newSigningLimiter()
+		auth := auth
+		auth.RateLimitPerMinute = 6
+		auth.RateLimitBurst = 1
+		release, _, err := l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		_, retryAfter, err := l.acquire(auth, 0, now.Add(time.Second))
+		if !errors.Is(err, errRateLimited) || retryAfter != 9*time.Second {
+			t.Fatalf("acquire() = %s, %v expected 9s, %v", retryAfter, err, errRateLimited)
+		}
+		if limitLabel(err) != "rate" {
+			t.Fatalf("limitLabel() = %q expected rate", limitLabel(err))
+		}
+		_, _, err = l.acquire(auth, 0, now.Add(10*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("token rotation", func(t *testing.T) {
+		l := newSigningLimiter()
+		auth := auth
+		auth.RateLimitPerMinute = 6
+		auth.RateLimitBurst = 1
+		_, _, err := l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// adding a rotation token doesn't refill the bucket
+		auth.ClientTokens = []clientToken{{ClientToken: other.ClientToken}}
+		_, _, err = l.acquire(auth, 0, now)
+		if !errors.Is(err, errRateLimited) {
+			t.Fatalf("acquire() after a token rotation error = %v expected %v", err, errRateLimited)
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		l := newSigningLimiter()
+		release, _, err := l.acquire(auth, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = l.acquire(other, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the state of removed authorizations is dropped once their
+		// signings are done
+		l.prune(nil)
+		if len(l.byAuth) != 2 {
+			t.Fatalf("prune() kept %d authorizations expected 2 with signings in progress", len(l.byAuth))
+		}
+		release()
+		l.prune([]authorization{other})
+		if _, ok := l.byAuth[auth.identity()]; ok || len(l.byAuth) != 1 {
+			t.Fatalf("prune() kept %d authorizations expected the remaining one", len(l.byAuth))
+		}
+	})
+}
+
+func Test_validateIdentities(t *testing.T) {
+	tests := []struct {
+		name    string
+		auths   []authorization
+		wantErr bool
+	}{
+		{"distinct", []authorization{{User: "alice", Signer: "a", DailyQuota: 1}, {User: "alice", Signer: "b", DailyQuota: 1}}, false},
+		{"shared without limits", []authorization{{User: "alice", Signer: "a"}, {User: "alice", Signer: "a"}}, false},
+		{"shared with a quota", []authorization{{User: "alice", Signer: "a"}, {User: "alice", Signer: "a", MonthlyQuota: 1}}, true},
+		{"shared with a rate limit", []authorization{{User: "alice", Signer: "a", RateLimitPerMinute: 1}, {User: "alice", Signer: "a"}}, true},
+		{"told apart by id", []authorization{{User: "alice", Signer: "a", RateLimitPerMinute: 1}, {ID: "ci", User: "alice", Signer: "a"}}, false},
+		{"same id", []authorization{{ID: "ci", User: "alice", Signer: "a", DailyQuota: 1}, {ID: "ci", User: "bob", Signer: "b"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateIdentities(tt.auths)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateIdentities() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    authorization
+		wantErr bool
+	}{
+		{"no limits", authorization{}, false},
+		{"all limits", authorization{RateLimitPerMinute: 0.5, RateLimitBurst: 2, MaxConcurrentSignings: 1}, false},
+		{"negative rate", authorization{RateLimitPerMinute: -1}, true},
+		{"negative burst", authorization{RateLimitPerMinute: 1, RateLimitBurst: -1}, true},
+		{"burst without rate", authorization{RateLimitBurst: 1}, true},
+		{"negative concurrency", authorization{MaxConcurrentSignings: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLimits(tt.auth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigHandlerRateLimit(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf, savedLimits := conf, signingLimits
+	defer func() { conf, signingLimits = savedConf, savedLimits }()
+	signingLimits = newSigningLimiter()
+	conf.BaseURL = autograph.URL + "/"
+	conf.upstream = newUpstreamClient(conf)
+	conf.Authorizations = append([]authorization{}, savedConf.Authorizations...)
+	conf.Authorizations[2].RateLimitPerMinute = 1
+
+	before := testutil.ToFloat64(limitedSignRequests.WithLabelValues(auth.User, auth.Signer, "rate"))
+	inProgressBefore := testutil.ToFloat64(signingsInProgress.WithLabelValues(auth.User, auth.Signer))
+	for i, expectedCode := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("input", "app.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("unsigned"))
+		mw.Close()
+		r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", auth.ClientToken)
+		w := httptest.NewRecorder()
+		sigHandler(w, r)
+		if w.Code != expectedCode {
+			t.Fatalf("request %d returned %d expected %d", i, w.Code, expectedCode)
+		}
+		if expectedCode == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Fatalf("request %d returned Retry-After %q expected 60", i, w.Header().Get("Retry-After"))
+		}
+	}
+	after := testutil.ToFloat64(limitedSignRequests.WithLabelValues(auth.User, auth.Signer, "rate"))
+	if after != before+1 {
+		t.Fatalf("rate limited requests went from %v to %v expected an increment of 1", before, after)
+	}
+	if inProgress := testutil.ToFloat64(signingsInProgress.WithLabelValues(auth.User, auth.Signer)); inProgress != inProgressBefore {
+		t.Fatalf("%v signings in progress after the requests completed expected %v", inProgress, inProgressBefore)
+	}
+}
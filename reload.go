@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// confMu guards the settings of conf that are replaced when the
+// configuration is reloaded
+var confMu sync.RWMutex
+
+// reloadConf parses and validates the configuration file again and,
+// only if it is valid, replaces the authorizations and authentication
+// settings of the active configuration. Settings of the listener and
+// upstream autograph require a restart and are kept, so their files
+// aren't loaded and their clients aren't built again.
+func reloadConf() error {
+	confMu.RLock()
+	path, baseURLOverride := conf.path, conf.baseURLOverride
+	confMu.RUnlock()
+
+	next, err := parseConf(path, baseURLOverride)
+	if err != nil {
+		return err
+	}
+
+	confMu.Lock()
+	defer confMu.Unlock()
+	for _, change := range diffAuthorizations(conf.Authorizations, next.Authorizations) {
+		log.Info(change)
+	}
+	for _, setting := range restartRequiredChanges(conf, next) {
+		log.Warnf("configuration setting %s changed but requires a restart to apply", setting)
+	}
+	conf.Authorizations = next.Authorizations
+	signingLimits.prune(conf.Authorizations)
+	conf.OIDC = next.OIDC
+	conf.TokenExpiryWarning = next.TokenExpiryWarning
+	return nil
+}
+
+// credentialIDs returns identifiers of the credentials an
+// authorization accepts that are safe to log: fingerprints of client
+// tokens, OIDC claims and client certificate bindings
+func (auth authorization) credentialIDs() (ids []string) {
+	for _, token := range auth.clientTokens() {
+		ids = append(ids, "client token "+token.fingerprint())
+	}
+	if len(auth.OIDCClaims) > 0 {
+		var claims []string
+		for name, value := range auth.OIDCClaims {
+			claims = append(claims, fmt.Sprintf("%s=%q", name, value))
+		}
+		sort.Strings(claims)
+		ids = append(ids, "OIDC claims "+strings.Join(claims, ","))
+	}
+	for _, subject := range auth.ClientCertSubjects {
+		ids = append(ids, fmt.Sprintf("client cert subject %q", subject))
+	}
+	for _, fp := range auth.ClientCertSPKISHA256 {
+		ids = append(ids, "client cert spki "+strings.ToLower(fp))
+	}
+	return ids
+}
+
+// diffAuthorizations returns messages describing the credentials
+// added, removed or whose authorization changed between two lists of
+// authorizations, sorted for stable output
+func diffAuthorizations(old, next []authorization) (changes []string) {
+	byCredential := func(auths []authorization) map[string]authorization {
+		m := make(map[string]authorization)
+		for _, auth := range auths {
+			for _, id := range auth.credentialIDs() {
+				m[id] = auth
+			}
+		}
+		return m
+	}
+	describe := func(auth authorization) string {
+		return fmt.Sprintf("(user %q signer %q)", auth.User, auth.Signer)
+	}
+	oldAuths, nextAuths := byCredential(old), byCredential(next)
+	for id, auth := range nextAuths {
+		oldAuth, existed := oldAuths[id]
+		switch {
+		case !existed:
+			changes = append(changes, fmt.Sprintf("added authorization for %s %s", id, describe(auth)))
+		case !reflect.DeepEqual(oldAuth, auth):
+			changes = append(changes, fmt.Sprintf("updated authorization for %s %s", id, describe(auth)))
+		}
+	}
+	for id, auth := range oldAuths {
+		if _, exists := nextAuths[id]; !exists {
+			changes = append(changes, fmt.Sprintf("removed authorization for %s %s", id, describe(auth)))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// restartRequiredChanges returns the names of the changed settings
+// that reloading the configuration doesn't apply
+func restartRequiredChanges(current, next configuration) (settings []string) {
+	for _, s := range []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"host", current.Host, next.Host},
+		{"port", current.Port, next.Port},
+		{"autograph_base_url", current.BaseURL, next.BaseURL},
+		{"autograph_upstreams", fmt.Sprint(current.AutographUpstreams), fmt.Sprint(next.AutographUpstreams)},
+		{"autograph_health_check_interval", current.AutographHealthCheckInterval, next.AutographHealthCheckInterval},
+		{"tls_cert", current.TLSCert, next.TLSCert},
+		{"tls_key", current.TLSKey, next.TLSKey},
+		{"tls_reload_interval", current.TLSReloadInterval, next.TLSReloadInterval},
+		{"tls_client_ca", current.TLSClientCA, next.TLSClientCA},
+		{"autograph_connect_timeout", current.AutographConnectTimeout, next.AutographConnectTimeout},
+		{"autograph_response_timeout", current.AutographResponseTimeout, next.AutographResponseTimeout},
+		{"autograph_attempt_timeout", current.AutographAttemptTimeout, next.AutographAttemptTimeout},
+		{"autograph_max_attempts", current.AutographMaxAttempts, next.AutographMaxAttempts},
+		{"autograph_retry_backoff", current.AutographRetryBackoff, next.AutographRetryBackoff},
+		{"autograph_circuit_breaker_threshold", current.AutographCircuitBreakerThreshold, next.AutographCircuitBreakerThreshold},
+		{"autograph_circuit_breaker_cooldown", current.AutographCircuitBreakerCooldown, next.AutographCircuitBreakerCooldown},
+		{"config_reload_interval", current.ConfigReloadInterval, next.ConfigReloadInterval},
+		{"shutdown_drain_period", current.ShutdownDrainPeriod, next.ShutdownDrainPeriod},
+		{"shutdown_timeout", current.ShutdownTimeout, next.ShutdownTimeout},
+		{"metrics_port", current.MetricsPort, next.MetricsPort},
+		{"max_concurrent_signings", current.MaxConcurrentSignings, next.MaxConcurrentSignings},
+		{"max_body_bytes", current.MaxBodyBytes, next.MaxBodyBytes},
+		{"temp_dir", current.TempDir, next.TempDir},
+		{"quota_file", current.QuotaFile, next.QuotaFile},
+		{"audit_log", current.AuditLog, next.AuditLog},
+		{"trusted_proxies", fmt.Sprint(current.TrustedProxies), fmt.Sprint(next.TrustedProxies)},
+		{"client_ip_header", current.ClientIPHeader, next.ClientIPHeader},
+		{"verify_signatures", current.VerifySignatures, next.VerifySignatures},
+		{"addon_root_certs", current.AddonRootCerts, next.AddonRootCerts},
+	} {
+		if s.current != s.next {
+			settings = append(settings, s.name)
+		}
+	}
+	return settings
+}
+
+// watchConf reloads the configuration whenever the modification time
+// of its file changes, checking at every interval
+func watchConf(interval time.Duration) {
+	var lastModTime time.Time
+	if info, err := os.Stat(conf.path); err == nil {
+		lastModTime = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(conf.path)
+		if err != nil {
+			log.Errorf("failed to check configuration file for changes: %v", err)
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) {
+			continue
+		}
+		lastModTime = info.ModTime()
+		err = reloadConf()
+		if err != nil {
+			log.Errorf("failed to reload changed configuration, keeping the current one: %v", err)
+			continue
+		}
+		log.Info("reloaded changed configuration")
+	}
+}
+
+// reloadOnSIGHUP reloads the configuration and the TLS certificate
+// and key whenever the process receives a SIGHUP
+func reloadOnSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		err := reloadConf()
+		if err != nil {
+			log.Errorf("failed to reload configuration on SIGHUP, keeping the current one: %v", err)
+		} else {
+			log.Info("reloaded configuration on SIGHUP")
+		}
+		if conf.certs == nil {
+			continue
+		}
+		err = conf.certs.reload()
+		if err != nil {
+			log.Errorf("failed to reload TLS certificate on SIGHUP: %v", err)
+			continue
+		}
+		log.Info("reloaded TLS certificate on SIGHUP")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testReloadConf = `autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547
+      addonid: myaddon@allizom.org
+      user: alice
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`
+
+const testReloadedConf = `autograph_base_url: http://localhost:8001/
+authorizations:
+    - client_token: dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd
+      user: alice
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+`
+
+func TestReloadConf(t *testing.T) {
+	savedConf := conf
+	defer func() { conf = savedConf }()
+
+	path := filepath.Join(t.TempDir(), "autograph-edge.yaml")
+	err := os.WriteFile(path, []byte(testReloadConf), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err = loadConf(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authorize("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", nil); err != nil {
+		t.Fatalf("authorize() error = %v before reload", err)
+	}
+
+	// an invalid configuration keeps the current one
+	err = os.WriteFile(path, []byte(testReloadConf+"    - client_token: tooshort\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConf(); err == nil {
+		t.Fatal("expected an error reloading an invalid configuration")
+	}
+	if _, err = authorize("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", nil); err != nil {
+		t.Fatalf("authorize() error = %v after failed reload", err)
+	}
+
+	err = os.WriteFile(path, []byte(testReloadedConf), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConf(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authorize("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", nil); err != errInvalidToken {
+		t.Fatalf("authorize() error = %v for removed token expected %v", err, errInvalidToken)
+	}
+	auth, err := authorize("dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd", nil)
+	if err != nil {
+		t.Fatalf("authorize() error = %v for added token", err)
+	}
+	if auth.Signer != "testapp-android" {
+		t.Fatalf("authorize() auth.Signer got %q expected %q", auth.Signer, "testapp-android")
+	}
+	// the upstream URL requires a restart
+	if conf.BaseURL != "http://localhost:8000/" {
+		t.Fatalf("conf.BaseURL changed to %q on reload", conf.BaseURL)
+	}
+
+	// reloads only parse the configuration and don't build the clients
+	// and stores of the settings that require a restart
+	next, err := parseConf(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.upstream != nil || next.quotas != nil {
+		t.Fatalf("parseConf() built upstream %v and quota store %v", next.upstream, next.quotas)
+	}
+}
+
+func Test_diffAuthorizations(t *testing.T) {
+	var (
+		alice = authorization{
+			ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			User:        "alice",
+			Signer:      "extensions-ecdsa",
+		}
+		aliceAPK = authorization{
+			ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			User:        "alice",
+			Signer:      "testapp-android",
+		}
+		bob = authorization{
+			ClientToken: "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+			User:        "bob",
+			Signer:      "testapp-android",
+		}
+		ci = authorization{
+			OIDCClaims: map[string]string{"repository": "mozilla/addon", "ref": "refs/heads/main"},
+			User:       "alice",
+			Signer:     "extensions-ecdsa",
+		}
+	)
+	expected := []string{
+		`added authorization for OIDC claims ref="refs/heads/main",repository="mozilla/addon" (user "alice" signer "extensions-ecdsa")`,
+		`removed authorization for client token ac05c8a3e115c129 (user "bob" signer "testapp-android")`,
+		`updated authorization for client token d6d8d9e23e67b471 (user "alice" signer "testapp-android")`,
+	}
+	got := diffAuthorizations([]authorization{alice, bob}, []authorization{aliceAPK, ci})
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("diffAuthorizations() = %q expected %q", got, expected)
+	}
+	if got := diffAuthorizations([]authorization{alice, bob}, []authorization{alice, bob}); len(got) != 0 {
+		t.Fatalf("diffAuthorizations() = %q for identical authorizations", got)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// draining is set when the server starts shutting down, so load
+// balancers stop sending it new requests
+var draining atomic.Bool
+
+// requestsContext is the parent context of requests. It is canceled
+// when in-flight requests outlive the shutdown timeout, which stops
+// their calls to autograph.
+var requestsContext, cancelRequests = context.WithCancel(context.Background())
+
+// lbHeartbeatHandler returns the version like versionHandler while
+// the server is serving, and a 503 once it is draining
+func lbHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		httpError(w, r, http.StatusServiceUnavailable, codeShuttingDown, "shutting down")
+		return
+	}
+	versionHandler(w, r)
+}
+
+// gracefulShutdown marks the server as draining, waits for the drain
+// period so load balancers notice, then shuts the server down, waiting
+// up to timeout for in-flight requests to complete
+func gracefulShutdown(server *http.Server, drainPeriod, timeout time.Duration) error {
+	draining.Store(true)
+	time.Sleep(drainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		cancelRequests()
+	}
+	return err
+}
+
+// shutdownOnSignal gracefully shuts the server down when the process
+// receives a SIGTERM or SIGINT. The returned channel is closed once
+// the shutdown completes. A second signal stops the process
+// immediately.
+func shutdownOnSignal(server *http.Server, drainPeriod, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer close(done)
+		s := <-sig
+		// restore the default behavior for a second signal
+		signal.Stop(sig)
+		log.Infof("received %s, draining for %s then waiting up to %s for in-flight requests", s, drainPeriod, timeout)
+		err := gracefulShutdown(server, drainPeriod, timeout)
+		if err != nil {
+			log.Errorf("failed to shut down gracefully: %v", err)
+		}
+	}()
+	return done
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	defer draining.Store(false)
+
+	server := prepareServer("127.0.0.1", 0)
+	mux := server.Handler
+	release := make(chan struct{})
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+			w.Write([]byte("done"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	baseURL := "http://" + ln.Addr().String()
+
+	res, err := http.Get(baseURL + "/__lbheartbeat__")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("lbheartbeat returned %d before shutdown expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	// start a request that is in-flight during the shutdown
+	slowBody := make(chan string)
+	go func() {
+		res, err := http.Get(baseURL + "/slow")
+		if err != nil {
+			slowBody <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		slowBody <- string(body)
+	}()
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- gracefulShutdown(server, 200*time.Millisecond, 5*time.Second)
+	}()
+
+	// during the drain period the server is still up but unhealthy
+	time.Sleep(50 * time.Millisecond)
+	res, err = http.Get(baseURL + "/__lbheartbeat__")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("lbheartbeat returned %d while draining expected %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if string(body) != "shutting down\n" {
+		t.Fatalf("lbheartbeat returned body %q while draining", body)
+	}
+
+	// the shutdown waits for the in-flight request
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err = <-shutdownErr:
+		t.Fatalf("shutdown completed with %v before the in-flight request", err)
+	default:
+	}
+	close(release)
+	if got := <-slowBody; got != "done" {
+		t.Fatalf("in-flight request returned %q expected %q", got, "done")
+	}
+	if err = <-shutdownErr; err != nil {
+		t.Fatalf("gracefulShutdown() error = %v", err)
+	}
+}
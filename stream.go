@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// base64ChunkSize is the size of the chunks input is read and
+	// base64 encoded in, a multiple of 3 so chunks don't need padding
+	base64ChunkSize = 3 * 16 << 10
+
+	// maxResponseFieldSize is the largest string field other than the
+	// signed file we're willing to read from an autograph response
+	maxResponseFieldSize = 1 << 20
+
+	// maxJSONDepth is the deepest nesting of arrays and objects in
+	// skipped JSON values, the same limit as encoding/json
+	maxJSONDepth = 10000
+)
+
+// spooledFile is a temporary file holding an input or signed file, so
+// it doesn't have to be held in memory. It keeps the size and SHA-256
+// digest of what's written to it.
+type spooledFile struct {
+	f    *os.File
+	size int64
+	hash hash.Hash
+}
+
+// newSpooledFile creates a spooled file in dir, or the default
+// directory for temporary files if it's empty
+func newSpooledFile(dir string) (*spooledFile, error) {
+	f, err := os.CreateTemp(dir, "autograph-edge-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary file")
+	}
+	return &spooledFile{f: f, hash: sha256.New()}, nil
+}
+
+func (s *spooledFile) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.hash.Write(p[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns a reader of what was written to the file
+func (s *spooledFile) reader() *io.SectionReader {
+	return io.NewSectionReader(s.f, 0, s.size)
+}
+
+// sha256 returns the hex encoded SHA-256 digest of the file
+func (s *spooledFile) sha256() string {
+	return fmt.Sprintf("%x", s.hash.Sum(nil))
+}
+
+// Close closes and removes the file
+func (s *spooledFile) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// formFilePart returns the part of a multipart/form-data request
+// holding the file of a form field, without reading the parts before
+// it into memory or temporary files like http.Request.FormFile
+func formFilePart(r *http.Request, name string) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil, http.ErrMissingFile
+			}
+			return nil, err
+		}
+		if part.FormName() == name && part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// the media types of the /sign requests and responses
+const (
+	mediaTypeFormData    = "multipart/form-data"
+	mediaTypeJSON        = "application/json"
+	mediaTypeOctetStream = "application/octet-stream"
+)
+
+// readSignInput writes the input of a /sign request to w, and returns
+// the media type it was read as. The input is the body of
+// application/octet-stream requests, the base64 encoded input field of
+// application/json requests, and the input file of multipart/form-data
+// requests, which is assumed for other content types.
+func readSignInput(r *http.Request, w io.Writer) (mediaType string, err error) {
+	mediaType, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case mediaTypeJSON:
+		return mediaType, decodeSignRequest(r.Body, w)
+	case mediaTypeOctetStream:
+		_, err = io.Copy(w, r.Body)
+		return mediaType, err
+	}
+	part, err := formFilePart(r, "input")
+	if err != nil {
+		return mediaTypeFormData, err
+	}
+	_, err = io.Copy(w, part)
+	return mediaTypeFormData, err
+}
+
+// acceptsJSON returns whether the Accept header of a request lists
+// application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, accepted := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(accepted)
+			if err == nil && mediaType == mediaTypeJSON {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isBodyTooLarge returns whether reading a request body failed because
+// it's larger than the limit of http.MaxBytesReader
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// maxSizeWriter writes to w until more than max bytes are written to
+// it, and then fails with errInputTooLarge. read counts the bytes
+// written to it including the ones over the limit.
+type maxSizeWriter struct {
+	w            io.Writer
+	max, n, read int64
+}
+
+func (m *maxSizeWriter) Write(p []byte) (int, error) {
+	m.read += int64(len(p))
+	if m.n+int64(len(p)) > m.max {
+		return 0, errInputTooLarge
+	}
+	n, err := m.w.Write(p)
+	m.n += int64(n)
+	return n, err
+}
+
+// base64EncodingReader base64 encodes what it reads from r
+type base64EncodingReader struct {
+	r        io.Reader
+	in, out  []byte
+	buffered []byte
+	err      error
+}
+
+func newBase64EncodingReader(r io.Reader) *base64EncodingReader {
+	return &base64EncodingReader{
+		r:   r,
+		in:  make([]byte, base64ChunkSize),
+		out: make([]byte, base64.StdEncoding.EncodedLen(base64ChunkSize)),
+	}
+}
+
+func (b *base64EncodingReader) Read(p []byte) (int, error) {
+	for len(b.buffered) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		n, err := io.ReadFull(b.r, b.in)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			b.err = io.EOF
+		default:
+			b.err = err
+		}
+		base64.StdEncoding.Encode(b.out, b.in[:n])
+		b.buffered = b.out[:base64.StdEncoding.EncodedLen(n)]
+	}
+	n := copy(p, b.buffered)
+	b.buffered = b.buffered[n:]
+	return n, nil
+}
+
+// base64DecodingWriter base64 decodes what's written to it to w. Close
+// must be called to check the encoded data wasn't truncated.
+type base64DecodingWriter struct {
+	w        io.Writer
+	buffered []byte
+	out      []byte
+}
+
+func newBase64DecodingWriter(w io.Writer) *base64DecodingWriter {
+	return &base64DecodingWriter{w: w}
+}
+
+func (d *base64DecodingWriter) Write(p []byte) (int, error) {
+	d.buffered = append(d.buffered, p...)
+	// decode whole quanta only, the rest waits for the next write
+	n := len(d.buffered) / 4 * 4
+	if n > 0 {
+		if cap(d.out) < base64.StdEncoding.DecodedLen(n) {
+			d.out = make([]byte, base64.StdEncoding.DecodedLen(n))
+		}
+		decoded, err := base64.StdEncoding.Decode(d.out[:cap(d.out)], d.buffered[:n])
+		if err != nil {
+			return 0, err
+		}
+		_, err = d.w.Write(d.out[:decoded])
+		if err != nil {
+			return 0, err
+		}
+		d.buffered = d.buffered[:copy(d.buffered, d.buffered[n:])]
+	}
+	return len(p), nil
+}
+
+func (d *base64DecodingWriter) Close() error {
+	if len(d.buffered) > 0 {
+		return base64.CorruptInputError(len(d.buffered))
+	}
+	return nil
+}
+
+// base64FieldBody returns a function returning readers of a marshaled
+// JSON object whose first field is an empty string, with the base64
+// encoding of data spliced in as its value, and their length
+func base64FieldBody(marshaled []byte, field string, data *io.SectionReader) (body func() io.Reader, length int64, err error) {
+	empty := `{"` + field + `":""`
+	if !bytes.HasPrefix(marshaled, []byte(empty)) {
+		return nil, 0, fmt.Errorf("unexpected encoding %q expected a first field %s", marshaled, field)
+	}
+	prefix := empty[:len(empty)-1]
+	suffix := string(marshaled[len(empty)-1:])
+	length = int64(len(prefix)) + int64(base64.StdEncoding.EncodedLen(int(data.Size()))) + int64(len(suffix))
+	body = func() io.Reader {
+		return io.MultiReader(
+			strings.NewReader(prefix),
+			newBase64EncodingReader(io.NewSectionReader(data, 0, data.Size())),
+			strings.NewReader(suffix),
+		)
+	}
+	return body, length, nil
+}
+
+// signatureRequestBody returns the JSON body of an autograph /sign/file
+// request for the input, base64 encoding it as the body is read, and
+// the length of the body
+func signatureRequestBody(request signaturerequest, input *io.SectionReader) (body func() io.Reader, length int64, err error) {
+	request.Input = ""
+	marshaled, err := json.Marshal(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	object, objectLength, err := base64FieldBody(marshaled, "input", input)
+	if err != nil {
+		return nil, 0, err
+	}
+	body = func() io.Reader {
+		return io.MultiReader(strings.NewReader("["), object(), strings.NewReader("]"))
+	}
+	return body, objectLength + 2, nil
+}
+
+// jsonStreamDecoder decodes the JSON values it needs from a reader
+// without holding the whole document in memory. depth is the nesting
+// of the value being skipped.
+type jsonStreamDecoder struct {
+	r     *bufio.Reader
+	depth int
+}
+
+// next returns the next byte that isn't whitespace
+func (d *jsonStreamDecoder) next() (byte, error) {
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return c, nil
+		}
+	}
+}
+
+// expect reads the next byte that isn't whitespace and checks it's c
+func (d *jsonStreamDecoder) expect(c byte) error {
+	got, err := d.next()
+	if err != nil {
+		return err
+	}
+	if got != c {
+		return fmt.Errorf("invalid JSON: found %q expected %q", got, c)
+	}
+	return nil
+}
+
+// readString writes the content of the string whose opening quote was
+// just read to w, unescaped
+func (d *jsonStreamDecoder) readString(w io.Writer) error {
+	buf := make([]byte, 0, 32<<10)
+	flush := func() error {
+		_, err := w.Write(buf)
+		buf = buf[:0]
+		return err
+	}
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == '"':
+			return flush()
+		case c < 0x20:
+			return fmt.Errorf("invalid JSON: control character in string")
+		case c == '\\':
+			c, err = d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			switch c {
+			case '"', '\\', '/':
+				buf = append(buf, c)
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'u':
+				r, err := d.readUnicodeEscape()
+				if err != nil {
+					return err
+				}
+				buf = utf8.AppendRune(buf, r)
+			default:
+				return fmt.Errorf("invalid JSON: invalid escape \\%c", c)
+			}
+		default:
+			buf = append(buf, c)
+		}
+		if len(buf) >= cap(buf)-utf8.UTFMax {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readUnicodeEscape reads the hex digits of a \u escape, and the low
+// surrogate that follows a high one
+func (d *jsonStreamDecoder) readUnicodeEscape() (rune, error) {
+	readHex := func() (rune, error) {
+		var hex [4]byte
+		_, err := io.ReadFull(d.r, hex[:])
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid JSON: invalid unicode escape %q", hex[:])
+		}
+		return rune(v), nil
+	}
+	r, err := readHex()
+	if err != nil || !utf16.IsSurrogate(r) {
+		return r, err
+	}
+	next, err := d.r.Peek(2)
+	if err != nil || string(next) != `\u` {
+		return utf8.RuneError, nil
+	}
+	d.r.Discard(2)
+	low, err := readHex()
+	if err != nil {
+		return 0, err
+	}
+	return utf16.DecodeRune(r, low), nil
+}
+
+// skipValue skips the value starting with c, and returns an error when
+// it nests arrays and objects deeper than maxJSONDepth rather than
+// running out of stack
+func (d *jsonStreamDecoder) skipValue(c byte) error {
+	switch c {
+	case '"':
+		return d.readString(io.Discard)
+	case '{', '[':
+		d.depth++
+		defer func() { d.depth-- }()
+		if d.depth > maxJSONDepth {
+			return fmt.Errorf("invalid JSON: nested deeper than %d", maxJSONDepth)
+		}
+		end := byte('}')
+		if c == '[' {
+			end = ']'
+		}
+		c, err := d.next()
+		if err != nil || c == end {
+			return err
+		}
+		for {
+			if end == '}' {
+				if c != '"' {
+					return fmt.Errorf("invalid JSON: found %q expected an object key", c)
+				}
+				err = d.readString(io.Discard)
+				if err == nil {
+					err = d.expect(':')
+				}
+				if err == nil {
+					c, err = d.next()
+				}
+				if err != nil {
+					return err
+				}
+			}
+			err = d.skipValue(c)
+			if err != nil {
+				return err
+			}
+			c, err = d.next()
+			if err != nil || c == end {
+				return err
+			}
+			if c != ',' {
+				return fmt.Errorf("invalid JSON: found %q expected ',' or %q", c, end)
+			}
+			c, err = d.next()
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		// numbers, true, false and null
+		var literal []byte
+		for {
+			literal = append(literal, c)
+			next, err := d.r.Peek(1)
+			if err == io.EOF || (err == nil && bytes.ContainsAny(next, " \t\r\n,]}")) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			c, _ = d.r.ReadByte()
+			if len(literal) > 64 {
+				return fmt.Errorf("invalid JSON: literal too long")
+			}
+		}
+		if !json.Valid(literal) {
+			return fmt.Errorf("invalid JSON: invalid literal %q", literal)
+		}
+		return nil
+	}
+}
+
+// readObject reads the fields of the object whose opening brace was
+// just read. It reads the string fields in fields to their strings, and
+// base64 decodes the string field streamed to w, returning whether it
+// was found. It fails if the streamed field is duplicated. Other fields
+// are skipped.
+func (d *jsonStreamDecoder) readObject(fields map[string]*string, streamed string, w io.Writer) (found bool, err error) {
+	c, err := d.next()
+	for err == nil && c != '}' {
+		if c != '"' {
+			return found, fmt.Errorf("invalid JSON: found %q expected an object key", c)
+		}
+		key := &limitedBuffer{max: maxResponseFieldSize}
+		err = d.readString(key)
+		if err == nil {
+			err = d.expect(':')
+		}
+		if err == nil {
+			c, err = d.next()
+		}
+		if err != nil {
+			return
+		}
+		field, known := fields[key.String()]
+		switch {
+		case key.String() == streamed && found:
+			// the values of duplicate keys would be concatenated
+			return found, fmt.Errorf("invalid JSON: duplicate %s", key)
+		case c == '"' && key.String() == streamed:
+			dec := newBase64DecodingWriter(w)
+			err = d.readString(dec)
+			if err == nil {
+				err = dec.Close()
+			}
+			if err != nil {
+				return found, errors.Wrapf(err, "failed to decode %s", key)
+			}
+			found = true
+		case c == '"' && known:
+			value := &limitedBuffer{max: maxResponseFieldSize}
+			err = d.readString(value)
+			if err != nil {
+				return found, errors.Wrapf(err, "failed to decode %s", key)
+			}
+			*field = value.String()
+		default:
+			err = d.skipValue(c)
+			if err != nil {
+				return
+			}
+		}
+		c, err = d.next()
+		if err == nil && c == ',' {
+			c, err = d.next()
+			if err == nil && c != '"' {
+				err = fmt.Errorf("invalid JSON: found %q expected an object key", c)
+			}
+		} else if err == nil && c != '}' {
+			err = fmt.Errorf("invalid JSON: found %q expected ',' or '}'", c)
+		}
+	}
+	return found, err
+}
+
+// limitedBuffer is a buffer that refuses to grow past max bytes
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("value is larger than %d bytes", b.max)
+	}
+	return b.Buffer.Write(p)
+}
+
+// decodeSignatureResponse decodes the JSON array of the responses to an
+// autograph /sign/file request, base64 decoding the signed file of the
+// response to signedFile as it's read. It returns the response with its
+// other fields, and errAutographBadResponseCount unless there is
+// exactly one. The response is decoded before its payload hash is
+// checked, so the fields it skips are also limited to maxJSONDepth.
+func decodeSignatureResponse(r io.Reader, signedFile io.Writer) (response signatureresponse, err error) {
+	d := &jsonStreamDecoder{r: bufio.NewReader(r)}
+	err = d.expect('[')
+	if err != nil {
+		return
+	}
+	c, err := d.next()
+	if err != nil {
+		return
+	}
+	if c == ']' {
+		return response, errAutographBadResponseCount
+	}
+	if c != '{' {
+		return response, fmt.Errorf("invalid JSON: found %q expected a signature response", c)
+	}
+	fields := map[string]*string{
+		"ref":        &response.Ref,
+		"type":       &response.Type,
+		"signer_id":  &response.SignerID,
+		"public_key": &response.PublicKey,
+		"signature":  &response.Signature,
+		"x5u":        &response.X5U,
+	}
+	_, err = d.readObject(fields, "signed_file", signedFile)
+	if err != nil {
+		return
+	}
+	c, err = d.next()
+	if err != nil {
+		return
+	}
+	if c != ']' {
+		return response, errAutographBadResponseCount
+	}
+	_, err = d.next()
+	if err != io.EOF {
+		return response, fmt.Errorf("invalid JSON: data after the signature responses")
+	}
+	return response, nil
+}
+
+// decodeSignRequest decodes the JSON body of a /sign request, base64
+// decoding its input to w as it's read
+func decodeSignRequest(r io.Reader, w io.Writer) error {
+	d := &jsonStreamDecoder{r: bufio.NewReader(r)}
+	err := d.expect('{')
+	if err != nil {
+		return err
+	}
+	found, err := d.readObject(nil, "input", w)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errMissingInput
+	}
+	_, err = d.next()
+	if err != io.EOF {
+		return fmt.Errorf("invalid JSON: data after the sign request")
+	}
+	return nil
+}
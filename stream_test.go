@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBase64EncodingReader(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 4, base64ChunkSize - 1, base64ChunkSize, 2*base64ChunkSize + 1} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encoded, err := io.ReadAll(iotest.HalfReader(newBase64EncodingReader(iotest.OneByteReader(bytes.NewReader(data)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != base64.StdEncoding.EncodeToString(data) {
+			t.Fatalf("base64 encoding of %d bytes does not match", size)
+		}
+	}
+}
+
+func TestBase64DecodingWriter(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	tests := []struct {
+		name      string
+		encoded   string
+		expected  []byte
+		expectErr bool
+	}{
+		{"valid", encoded, data, false},
+		{"empty", "", nil, false},
+		{"truncated", encoded[:len(encoded)-1], nil, true},
+		{"invalid", "!" + encoded[1:], nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var decoded bytes.Buffer
+			dec := newBase64DecodingWriter(&decoded)
+			var err error
+			// write in pieces that aren't whole quanta
+			for s := tt.encoded; len(s) > 0 && err == nil; {
+				n := 7
+				if n > len(s) {
+					n = len(s)
+				}
+				_, err = dec.Write([]byte(s[:n]))
+				s = s[n:]
+			}
+			if err == nil {
+				err = dec.Close()
+			}
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("base64DecodingWriter error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !bytes.Equal(decoded.Bytes(), tt.expected) {
+				t.Fatalf("base64DecodingWriter decoded %d bytes that do not match", decoded.Len())
+			}
+		})
+	}
+}
+
+func TestSignatureRequestBody(t *testing.T) {
+	input := make([]byte, 100000)
+	rand.Read(input)
+	request := signaturerequest{
+		KeyID:   "extensions-ecdsa",
+		Options: xpiOptions{ID: "myaddon@allizom.org", PKCS7Digest: "SHA256"},
+	}
+	body, length, err := signatureRequestBody(request, sectionReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body can be read for every attempt
+	for attempt := 0; attempt < 2; attempt++ {
+		data, err := io.ReadAll(body())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != length {
+			t.Fatalf("body is %d bytes long expected %d", len(data), length)
+		}
+		var requests []signaturerequest
+		err = json.Unmarshal(data, &requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Input = base64.StdEncoding.EncodeToString(input)
+		expected, _ := json.Marshal([]signaturerequest{request})
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("body does not match the JSON encoding of the request")
+		}
+	}
+}
+
+func TestDecodeSignatureResponse(t *testing.T) {
+	signed := base64.StdEncoding.EncodeToString([]byte("signed file"))
+	tests := []struct {
+		name             string
+		body             string
+		expectedResponse signatureresponse
+		expectedSigned   string
+		expectedErr      error
+	}{
+		{
+			name: "response",
+			body: `[{"ref":"abc","type":"apk2","mode":"","signer_id":"testapp-android","public_key":"","signature":"",` +
+				`"signed_file":"` + signed + `","x5u":"","signer_opts":{"a":[1,2.5,true,null,{"b":"\"c"}]}}]`,
+			expectedResponse: signatureresponse{Ref: "abc", Type: "apk2", SignerID: "testapp-android"},
+			expectedSigned:   "signed file",
+		},
+		{
+			name:             "whitespace and escapes",
+			body:             " [ {\n\t\"signed_file\" : \"" + strings.ReplaceAll(signed, "/", `\/`) + "\" , \"ref\": \"\\u00e9\\ud83d\\ude00\" } ]\n",
+			expectedResponse: signatureresponse{Ref: "é😀"},
+			expectedSigned:   "signed file",
+		},
+		{
+			name:        "no response",
+			body:        `[]`,
+			expectedErr: errAutographBadResponseCount,
+		},
+		{
+			name:           "two responses",
+			body:           `[{"signed_file":"` + signed + `"},{"signed_file":"` + signed + `"}]`,
+			expectedSigned: "signed file",
+			expectedErr:    errAutographBadResponseCount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var signedFile bytes.Buffer
+			response, err := decodeSignatureResponse(iotest.OneByteReader(strings.NewReader(tt.body)), &signedFile)
+			if err != tt.expectedErr {
+				t.Fatalf("decodeSignatureResponse() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if response != tt.expectedResponse {
+				t.Fatalf("decodeSignatureResponse() = %+v expected %+v", response, tt.expectedResponse)
+			}
+			if signedFile.String() != tt.expectedSigned {
+				t.Fatalf("decodeSignatureResponse() signed file = %q expected %q", signedFile.String(), tt.expectedSigned)
+			}
+		})
+	}
+
+	for _, body := range []string{
+		``,
+		`{}`,
+		`[{"signed_file":"` + signed[1:] + `"}]`,
+		`[{"signed_file":"` + signed + `"`,
+		`[{"signed_file":"` + signed + `",}]`,
+		`[{"signed_file":"` + signed + `"}] []`,
+		`[{"signed_file":"` + signed + `","ref":tru}]`,
+		`[{"signed_file":"` + signed + `","ref":"\x"}]`,
+		`[{"ref":"` + strings.Repeat("a", maxResponseFieldSize+1) + `"}]`,
+		`[{"signed_file":"` + signed + `","signed_file":"` + signed + `"}]`,
+	} {
+		_, err := decodeSignatureResponse(strings.NewReader(body), io.Discard)
+		if err == nil {
+			t.Errorf("decodeSignatureResponse(%.40q) expected an error", body)
+		}
+	}
+}
+
+func TestFormFilePart(t *testing.T) {
+	newRequest := func(field, filename string) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("comment", "not the input")
+		fw, err := mw.CreateFormFile(field, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("unsigned"))
+		mw.Close()
+		r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	part, err := formFilePart(newRequest("input", "app.apk"), "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := newSpooledFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	_, err = io.Copy(input, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(input.reader())
+	if string(data) != "unsigned" {
+		t.Fatalf("spooled input = %q expected %q", data, "unsigned")
+	}
+	if input.sha256() != "ceffe727ab2fa2c7c3322ee4a1aa0c2d2a4664836c2133df93dd15055bb617be" {
+		t.Fatalf("spooled input has SHA-256 %s", input.sha256())
+	}
+
+	_, err = formFilePart(newRequest("other", "app.apk"), "input")
+	if !errors.Is(err, http.ErrMissingFile) {
+		t.Fatalf("formFilePart() error = %v expected %v", err, http.ErrMissingFile)
+	}
+	_, err = formFilePart(httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader("unsigned")), "input")
+	if err == nil {
+		t.Fatal("formFilePart() of a request that isn't multipart expected an error")
+	}
+}
+
+func TestDecodeSignRequest(t *testing.T) {
+	input := base64.StdEncoding.EncodeToString([]byte("unsigned"))
+	tests := []struct {
+		name          string
+		body          string
+		expectedInput string
+		expectedErr   error
+	}{
+		{"request", `{"input":"` + input + `"}`, "unsigned", nil},
+		{"other fields", ` {"keyid":"testapp-android", "input" : "` + input + `", "options":{"zip":"all"}}` + "\n", "unsigned", nil},
+		{"missing input", `{"keyid":"testapp-android"}`, "", errMissingInput},
+		{"nested fields", `{"options":` + strings.Repeat(`[{"a":`, maxJSONDepth/2) + "1" + strings.Repeat("}]", maxJSONDepth/2) + `,"input":"` + input + `"}`, "unsigned", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var decoded bytes.Buffer
+			err := decodeSignRequest(iotest.OneByteReader(strings.NewReader(tt.body)), &decoded)
+			if err != tt.expectedErr {
+				t.Fatalf("decodeSignRequest() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if decoded.String() != tt.expectedInput {
+				t.Fatalf("decodeSignRequest() input = %q expected %q", decoded.String(), tt.expectedInput)
+			}
+		})
+	}
+
+	for _, body := range []string{
+		``,
+		`[{"input":"` + input + `"}]`,
+		`{"input":"` + input[1:] + `"}`,
+		`{"input":"` + input + `"`,
+		`{"input":"` + input + `"} {}`,
+		`{"input":"QUFB","input":"QkJC"}`,
+		`{"options":` + strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1) + `,"input":"QUFB"}`,
+	} {
+		err := decodeSignRequest(strings.NewReader(body), io.Discard)
+		if err == nil {
+			t.Errorf("decodeSignRequest(%q) expected an error", body)
+		}
+	}
+}
+
+func TestMaxSizeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &maxSizeWriter{w: &buf, max: 5}
+	_, err := w.Write([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("de"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("f"))
+	if err != errInputTooLarge {
+		t.Fatalf("Write() over the maximum error = %v expected %v", err, errInputTooLarge)
+	}
+	if buf.String() != "abcde" {
+		t.Fatalf("maxSizeWriter wrote %q expected %q", buf.String(), "abcde")
+	}
+}
+
+func Test_acceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept   []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"*/*"}, false},
+		{[]string{"application/json"}, true},
+		{[]string{"application/octet-stream;q=0.9, Application/JSON; charset=utf-8"}, true},
+		{[]string{"text/plain", "application/json"}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+		for _, value := range tt.accept {
+			r.Header.Add("Accept", value)
+		}
+		if acceptsJSON(r) != tt.expected {
+			t.Errorf("acceptsJSON(%q) = %v expected %v", tt.accept, !tt.expected, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves the TLS certificate and key loaded from disk
+// and reloads them when the files change, so certificates can be
+// renewed without restarting. Connections established before a
+// reload keep using the previous certificate.
+type certReloader struct {
+	sync.RWMutex
+
+	certPath, keyPath       string
+	cert                    *tls.Certificate
+	certModTime, keyModTime time.Time
+}
+
+// newCertReloader returns a certReloader with the certificate and
+// key loaded from their paths
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// modTimes returns the modification times of the certificate and key
+func (cr *certReloader) modTimes() (certModTime, keyModTime time.Time, err error) {
+	certInfo, err := os.Stat(cr.certPath)
+	if err != nil {
+		return
+	}
+	keyInfo, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// reload loads the certificate and key from disk, keeping the
+// current ones if they fail to load
+func (cr *certReloader) reload() error {
+	certModTime, keyModTime, err := cr.modTimes()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat TLS certificate and key")
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS certificate and key")
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	cr.cert = &cert
+	cr.certModTime, cr.keyModTime = certModTime, keyModTime
+	return nil
+}
+
+// reloadIfChanged reloads the certificate and key when either file
+// was modified since they were last loaded
+func (cr *certReloader) reloadIfChanged() error {
+	certModTime, keyModTime, err := cr.modTimes()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat TLS certificate and key")
+	}
+	cr.RLock()
+	changed := !certModTime.Equal(cr.certModTime) || !keyModTime.Equal(cr.keyModTime)
+	cr.RUnlock()
+	if !changed {
+		return nil
+	}
+	return cr.reload()
+}
+
+// watch checks the certificate and key for changes at every interval
+func (cr *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := cr.reloadIfChanged()
+		if err != nil {
+			log.Errorf("failed to reload TLS certificate: %v", err)
+		}
+	}
+}
+
+// getCertificate returns the current certificate for tls.Config
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server: TLS
+// 1.2 or later with forward secret AEAD cipher suites, serving the
+// certificate of the reloader. When clientCAs is set, it requests and
+// verifies client certificates, but clients without a certificate can
+// still connect to authenticate with a token.
+func serverTLSConfig(certs *certReloader, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// only used for TLS 1.2, TLS 1.3 suites aren't configurable
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		GetCertificate: certs.getCertificate,
+	}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// validateTLSConfiguration checks that TLS is configured when client
+// certificates are requested and that authorizations only bind to
+// client certificates when a client CA bundle is configured.
+func validateTLSConfiguration(c *configuration) error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("tls_client_ca requires tls_cert and tls_key")
+	}
+	if c.TLSClientCA == "" {
+		for i, auth := range c.Authorizations {
+			if auth.hasClientCertBindings() {
+				return fmt.Errorf("auth %d binds to client certificates but tls_client_ca is not configured", i)
+			}
+		}
+	}
+	return nil
+}
+
+// loadTLSConfiguration loads the TLS certificate and key and the client
+// CA bundle
+func loadTLSConfiguration(c *configuration) error {
+	var err error
+	if c.TLSCert != "" {
+		c.certs, err = newCertReloader(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return err
+		}
+	}
+	if c.TLSClientCA != "" {
+		c.clientCAs, err = loadClientCAs(c.TLSClientCA)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
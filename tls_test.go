@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPreparedServerTLSReload(t *testing.T) {
+	ca, caKey := makeTestCert(t, "test CA", nil, nil)
+	first, firstKey := makeTestCert(t, "autograph-edge", ca, caKey)
+	second, secondKey := makeTestCert(t, "autograph-edge", ca, caKey)
+
+	dir := t.TempDir()
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.TLSCert, conf.TLSKey = writeTestCertFiles(t, dir, first, firstKey)
+	err := loadTLSConfiguration(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := prepareServer("127.0.0.1", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	servedCert := func() *x509.Certificate {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.Version != tls.VersionTLS12 {
+			t.Fatalf("negotiated TLS version %x expected %x", state.Version, tls.VersionTLS12)
+		}
+		return state.PeerCertificates[0]
+	}
+	if got := servedCert(); !got.Equal(first) {
+		t.Fatalf("served certificate serial %s expected %s", got.SerialNumber, first.SerialNumber)
+	}
+
+	// replace the certificate on disk and make sure the change is
+	// detected even on filesystems with coarse modification times
+	writeTestCertFiles(t, dir, second, secondKey)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{conf.TLSCert, conf.TLSKey} {
+		err = os.Chtimes(path, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = conf.certs.reloadIfChanged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCert(); !got.Equal(second) {
+		t.Fatalf("served certificate serial %s expected %s after reload", got.SerialNumber, second.SerialNumber)
+	}
+
+	// a broken certificate keeps serving the previous one
+	err = os.WriteFile(conf.TLSCert, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.certs.reload(); err == nil {
+		t.Fatal("expected an error reloading an invalid certificate")
+	}
+	if got := servedCert(); !got.Equal(second) {
+		t.Fatalf("served certificate serial %s expected %s after failed reload", got.SerialNumber, second.SerialNumber)
+	}
+
+	// old TLS versions are refused
+	_, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS11})
+	if err == nil {
+		t.Fatal("expected TLS 1.1 handshake to fail")
+	}
+}
+
+func TestServerTLSConfigClientAuth(t *testing.T) {
+	cfg := serverTLSConfig(&certReloader{}, nil)
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("ClientAuth = %v expected %v without client CAs", cfg.ClientAuth, tls.NoClientCert)
+	}
+	cfg = serverTLSConfig(&certReloader{}, x509.NewCertPool())
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("ClientAuth = %v expected %v with client CAs", cfg.ClientAuth, tls.VerifyClientCertIfGiven)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenFingerprintLength is the number of hex characters of a token
+// hash used to identify it in logs and expiry warnings
+const tokenFingerprintLength = 16
+
+// clientToken is a token clients send in their Authorization header,
+// stored either in plaintext or as a salted SHA-256 hash, and valid
+// between the optional NotBefore and ExpiresAt timestamps
+type clientToken struct {
+	ClientToken       string    `yaml:"client_token"`
+	ClientTokenSHA256 string    `yaml:"client_token_sha256"`
+	ClientTokenSalt   string    `yaml:"client_token_salt"`
+	NotBefore         time.Time `yaml:"not_before"`
+	ExpiresAt         time.Time `yaml:"expires_at"`
+}
+
+// clientTokens returns the tokens of an authorization: the top level
+// token if there is one followed by the tokens of ClientTokens. The
+// validity period of each token is narrowed to the validity period
+// of the authorization.
+func (auth authorization) clientTokens() (tokens []clientToken) {
+	if auth.ClientToken != "" || auth.ClientTokenSHA256 != "" || auth.ClientTokenSalt != "" {
+		tokens = append(tokens, clientToken{
+			ClientToken:       auth.ClientToken,
+			ClientTokenSHA256: auth.ClientTokenSHA256,
+			ClientTokenSalt:   auth.ClientTokenSalt,
+			NotBefore:         auth.NotBefore,
+			ExpiresAt:         auth.ExpiresAt,
+		})
+	}
+	for _, token := range auth.ClientTokens {
+		if token.NotBefore.Before(auth.NotBefore) {
+			token.NotBefore = auth.NotBefore
+		}
+		if token.ExpiresAt.IsZero() || (!auth.ExpiresAt.IsZero() && auth.ExpiresAt.Before(token.ExpiresAt)) {
+			token.ExpiresAt = auth.ExpiresAt
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// hashClientToken returns the hex encoded SHA-256 digest of the salt
+// followed by the client token
+func hashClientToken(salt, token string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// matches returns whether the client token sent in a request matches
+// the plaintext or hashed token. Both comparisons are constant time.
+func (t clientToken) matches(token string) bool {
+	if t.ClientTokenSHA256 == "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(t.ClientToken)) == 1
+	}
+	expected, err := hex.DecodeString(t.ClientTokenSHA256)
+	if err != nil {
+		return false
+	}
+	got := sha256.Sum256([]byte(t.ClientTokenSalt + token))
+	return subtle.ConstantTimeCompare(got[:], expected) == 1
+}
+
+// checkValidity returns an error when the token isn't valid yet or
+// has expired at the given time
+func (t clientToken) checkValidity(now time.Time) error {
+	if !t.NotBefore.IsZero() && now.Before(t.NotBefore) {
+		return errTokenNotYetValid
+	}
+	if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+		return errTokenExpired
+	}
+	return nil
+}
+
+// fingerprint returns a prefix of the (salted) SHA-256 hash of the
+// token, which identifies it without revealing the token itself
+func (t clientToken) fingerprint() string {
+	hash := strings.ToLower(t.ClientTokenSHA256)
+	if hash == "" {
+		hash = hashClientToken("", t.ClientToken)
+	}
+	if len(hash) > tokenFingerprintLength {
+		hash = hash[:tokenFingerprintLength]
+	}
+	return hash
+}
+
+// validate returns an error for tokens with:
+//
+// a short (<60 chars) ClientToken, or an invalid ClientTokenSHA256
+// neither or both of ClientToken and ClientTokenSHA256
+// a salt for a plaintext ClientToken
+// an ExpiresAt before NotBefore
+func (t clientToken) validate() error {
+	switch {
+	case t.ClientToken != "" && t.ClientTokenSHA256 != "":
+		return fmt.Errorf("only one of client token and client token sha256 can be set")
+	case t.ClientTokenSHA256 != "":
+		err := validateClientTokenHash(t.ClientTokenSHA256)
+		if err != nil {
+			return err
+		}
+	case len(t.ClientToken) < 60:
+		return fmt.Errorf("client token is too short (%d chars) want at least 60", len(t.ClientToken))
+	case t.ClientTokenSalt != "":
+		return fmt.Errorf("client token salt is only used with client token sha256")
+	}
+	if !t.NotBefore.IsZero() && !t.ExpiresAt.IsZero() && !t.NotBefore.Before(t.ExpiresAt) {
+		return fmt.Errorf("client token %s expires at %s before it becomes valid at %s",
+			t.fingerprint(), t.ExpiresAt.Format(time.RFC3339), t.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validateClientTokenHash returns an error when a hashed client token
+// isn't a hex encoded SHA-256 digest
+func validateClientTokenHash(tokenHash string) error {
+	decoded, err := hex.DecodeString(tokenHash)
+	if err != nil {
+		return fmt.Errorf("client token sha256 is not hex encoded: %v", err)
+	}
+	if len(decoded) != sha256.Size {
+		return fmt.Errorf("client token sha256 is %d bytes long want %d", len(decoded), sha256.Size)
+	}
+	return nil
+}
+
+// findExpiringClientTokens returns a list of warnings for the
+// tokens of auths that are valid now but expire within the window
+func findExpiringClientTokens(auths []authorization, now time.Time, window time.Duration) (warnings []string) {
+	for i, auth := range auths {
+		for _, token := range auth.clientTokens() {
+			if token.ExpiresAt.IsZero() || token.checkValidity(now) != nil {
+				continue
+			}
+			if token.ExpiresAt.Sub(now) <= window {
+				warnings = append(warnings, fmt.Sprintf("client token %s of auth %d (user %q signer %q) expires at %s",
+					token.fingerprint(), i, auth.User, auth.Signer, token.ExpiresAt.UTC().Format(time.RFC3339)))
+			}
+		}
+	}
+	return warnings
+}
+
+// expiryWarnings logs the warnings of expiring client tokens at most
+// once per warning window, rather than on every heartbeat
+var expiryWarnings = &expiryWarner{logged: make(map[string]time.Time)}
+
+// expiryWarner remembers when warnings were last logged
+type expiryWarner struct {
+	sync.Mutex
+	logged map[string]time.Time
+}
+
+// log logs the warnings that weren't logged within the window and
+// forgets the ones logged before it
+func (e *expiryWarner) log(warnings []string, now time.Time, window time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+
+	for warning, loggedAt := range e.logged {
+		if now.Sub(loggedAt) >= window {
+			delete(e.logged, warning)
+		}
+	}
+	for _, warning := range warnings {
+		if _, ok := e.logged[warning]; ok {
+			continue
+		}
+		log.Warn(warning)
+		e.logged[warning] = now
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func Test_clientTokenCheckValidity(t *testing.T) {
+	var (
+		notBefore = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		expiresAt = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	)
+	tests := []struct {
+		name        string
+		token       clientToken
+		now         time.Time
+		expectedErr error
+	}{
+		{
+			name:        "no validity period",
+			token:       clientToken{},
+			now:         notBefore,
+			expectedErr: nil,
+		},
+		{
+			name:        "before not before",
+			token:       clientToken{NotBefore: notBefore, ExpiresAt: expiresAt},
+			now:         notBefore.Add(-time.Second),
+			expectedErr: errTokenNotYetValid,
+		},
+		{
+			name:        "at not before",
+			token:       clientToken{NotBefore: notBefore, ExpiresAt: expiresAt},
+			now:         notBefore,
+			expectedErr: nil,
+		},
+		{
+			name:        "at expires at",
+			token:       clientToken{NotBefore: notBefore, ExpiresAt: expiresAt},
+			now:         expiresAt,
+			expectedErr: errTokenExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.token.checkValidity(tt.now); err != tt.expectedErr {
+				t.Fatalf("checkValidity() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func Test_authorizationClientTokens(t *testing.T) {
+	var (
+		jan = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		feb = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+		mar = time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	)
+	auth := authorization{
+		ClientToken: "top",
+		NotBefore:   feb,
+		ExpiresAt:   mar,
+		ClientTokens: []clientToken{
+			{ClientToken: "unbounded"},
+			{ClientToken: "wider", NotBefore: jan, ExpiresAt: mar.AddDate(0, 1, 0)},
+			{ClientToken: "narrower", NotBefore: feb.AddDate(0, 0, 1), ExpiresAt: mar.AddDate(0, 0, -1)},
+		},
+	}
+	expected := []clientToken{
+		{ClientToken: "top", NotBefore: feb, ExpiresAt: mar},
+		{ClientToken: "unbounded", NotBefore: feb, ExpiresAt: mar},
+		{ClientToken: "wider", NotBefore: feb, ExpiresAt: mar},
+		{ClientToken: "narrower", NotBefore: feb.AddDate(0, 0, 1), ExpiresAt: mar.AddDate(0, 0, -1)},
+	}
+	if got := auth.clientTokens(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("clientTokens() = %+v, expected %+v", got, expected)
+	}
+}
+
+func Test_findExpiringClientTokens(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	auths := []authorization{
+		authorization{
+			ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			User:        "alice",
+			Signer:      "extensions-ecdsa",
+		},
+		authorization{
+			ClientTokens: []clientToken{
+				{
+					ClientToken: "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880",
+					ExpiresAt:   now.Add(time.Hour),
+				},
+				{
+					ClientToken: "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+					ExpiresAt:   now.Add(30 * 24 * time.Hour),
+				},
+				{
+					ClientToken: "5c5807737e563bfa2be56d6acd7f74cb2cdcabec4dfc9c120c2e8a03a7f92fd0",
+					ExpiresAt:   now.Add(-time.Hour),
+				},
+			},
+			User:   "bob",
+			Signer: "testapp-android",
+		},
+	}
+	expected := []string{
+		`client token cbe16cb8ff1d11c5 of auth 1 (user "bob" signer "testapp-android") expires at 2020-01-01T01:00:00Z`,
+	}
+	got := findExpiringClientTokens(auths, now, 7*24*time.Hour)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("findExpiringClientTokens() = %q, expected %q", got, expected)
+	}
+}
+
+func Test_expiryWarnerLog(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := 7 * 24 * time.Hour
+	warner := &expiryWarner{logged: make(map[string]time.Time)}
+	logs := []struct {
+		warnings []string
+		now      time.Time
+		expected int
+	}{
+		{[]string{"token a expires"}, now, 1},
+		// every heartbeat within the window logs new warnings only
+		{[]string{"token a expires", "token b expires"}, now.Add(time.Minute), 2},
+		{[]string{"token a expires", "token b expires"}, now.Add(time.Hour), 2},
+		// and warnings are logged again after the window
+		{[]string{"token a expires", "token b expires"}, now.Add(window), 3},
+		{[]string{"token a expires", "token b expires"}, now.Add(window + time.Minute), 4},
+	}
+	for i, l := range logs {
+		warner.log(l.warnings, l.now, window)
+		if len(hook.AllEntries()) != l.expected {
+			t.Fatalf("log %d: logged %d warnings expected %d", i, len(hook.AllEntries()), l.expected)
+		}
+	}
+}
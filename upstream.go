@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// circuit breaker states reported in the heartbeat
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker stops sending requests to autograph after threshold
+// consecutive failures. Once cooldown has passed, a single trial
+// request is let through: it closes the circuit if it succeeds and
+// opens it again if it fails.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	url       string
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	state    string
+	openedAt time.Time
+	// trialInFlight is set while the half-open trial request runs
+	trialInFlight bool
+}
+
+func newCircuitBreaker(url string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		url:       url,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     circuitClosed,
+	}
+}
+
+// allow returns errAutographCircuitOpen when a request can't be sent
+// to autograph at the given time
+func (cb *circuitBreaker) allow(now time.Time) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return errAutographCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.trialInFlight = true
+		return nil
+	case circuitHalfOpen:
+		if cb.trialInFlight {
+			return errAutographCircuitOpen
+		}
+		cb.trialInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// available returns whether allow would let a request through at the
+// given time, without starting a trial request
+func (cb *circuitBreaker) available(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		return now.Sub(cb.openedAt) >= cb.cooldown
+	case circuitHalfOpen:
+		return !cb.trialInFlight
+	default:
+		return true
+	}
+}
+
+// success records a request autograph handled and closes the circuit
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != circuitClosed {
+		log.Infof("autograph %s circuit breaker closed", cb.url)
+	}
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.trialInFlight = false
+}
+
+// release ends the half-open trial request without an outcome, when it
+// wasn't sent or was canceled by the client, so the next request can be
+// the trial
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trialInFlight = false
+}
+
+// failure records a failed request and opens the circuit when the
+// threshold is reached or the half-open trial request failed
+func (cb *circuitBreaker) failure(now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	cb.trialInFlight = false
+	if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.failures >= cb.threshold) {
+		log.Warnf("autograph %s circuit breaker opened after %d consecutive failures", cb.url, cb.failures)
+		cb.state = circuitOpen
+		cb.openedAt = now
+	}
+}
+
+// status returns the state of the circuit
+func (cb *circuitBreaker) status() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// upstreamConfiguration is an autograph endpoint requests can be sent
+// to. Lower priorities are preferred, and requests are spread between
+// upstreams of the same priority proportionally to their weight.
+type upstreamConfiguration struct {
+	URL      string `yaml:"url"`
+	Priority int    `yaml:"priority"`
+	Weight   int    `yaml:"weight"`
+}
+
+// upstreamConfigurations returns the configured autograph upstreams,
+// or a single upstream for BaseURL
+func (c configuration) upstreamConfigurations() []upstreamConfiguration {
+	if len(c.AutographUpstreams) > 0 {
+		return c.AutographUpstreams
+	}
+	return []upstreamConfiguration{{URL: c.BaseURL}}
+}
+
+// upstreamURLs returns the URLs of the autograph upstreams for logging
+func (c configuration) upstreamURLs() string {
+	var urls []string
+	for _, u := range c.upstreamConfigurations() {
+		urls = append(urls, u.URL)
+	}
+	return strings.Join(urls, ", ")
+}
+
+// upstreamEndpoint is an autograph upstream with its circuit breaker
+// and the result of its last health check
+type upstreamEndpoint struct {
+	upstreamConfiguration
+	breaker *circuitBreaker
+	healthy atomic.Bool
+}
+
+// setHealthy records the result of a health check of the upstream
+func (ep *upstreamEndpoint) setHealthy(healthy bool, err error) {
+	if ep.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		log.Infof("autograph upstream %s is healthy", ep.URL)
+	} else {
+		log.Warnf("autograph upstream %s is unhealthy: %v", ep.URL, err)
+	}
+}
+
+// upstreamClient sends requests to the autograph upstreams with
+// connect and response timeouts, retries of failed attempts with
+// jittered exponential backoff, and a circuit breaker per upstream
+type upstreamClient struct {
+	httpClient     *http.Client
+	attemptTimeout time.Duration
+	maxAttempts    int
+	retryBackoff   time.Duration
+	endpoints      []*upstreamEndpoint
+}
+
+// newUpstreamClient returns an upstreamClient using the autograph
+// settings of a configuration. Upstreams start healthy until their
+// first health check.
+func newUpstreamClient(c configuration) *upstreamClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   c.AutographConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = c.AutographConnectTimeout
+	transport.ResponseHeaderTimeout = c.AutographResponseTimeout
+	uc := &upstreamClient{
+		httpClient:     &http.Client{Transport: transport},
+		attemptTimeout: c.AutographAttemptTimeout,
+		maxAttempts:    c.AutographMaxAttempts,
+		retryBackoff:   c.AutographRetryBackoff,
+	}
+	for _, u := range c.upstreamConfigurations() {
+		if u.Weight == 0 {
+			u.Weight = 1
+		}
+		ep := &upstreamEndpoint{
+			upstreamConfiguration: u,
+			breaker:               newCircuitBreaker(u.URL, c.AutographCircuitBreakerThreshold, c.AutographCircuitBreakerCooldown),
+		}
+		ep.healthy.Store(true)
+		uc.endpoints = append(uc.endpoints, ep)
+	}
+	return uc
+}
+
+// Get implements heartbeatRequester. Heartbeats are neither retried
+// nor counted by the circuit breakers.
+func (uc *upstreamClient) Get(url string) (*http.Response, error) {
+	return uc.httpClient.Get(url)
+}
+
+// checkHealth requests the heartbeat of every upstream and records
+// whether it is healthy
+func (uc *upstreamClient) checkHealth() {
+	for _, ep := range uc.endpoints {
+		err := probeHeartbeat(uc, ep.URL)
+		ep.setHealthy(err == nil, err)
+	}
+}
+
+// watchHealth checks the health of the upstreams every interval
+func (uc *upstreamClient) watchHealth(interval time.Duration) {
+	for range time.Tick(interval) {
+		uc.checkHealth()
+	}
+}
+
+// pick returns the upstream to send the next attempt to. It prefers
+// healthy upstreams whose circuit is closed and that weren't tried
+// yet, and among those the ones with the lowest priority, chosen at
+// random by weight. When no upstream is healthy, the ones whose
+// circuit is closed are tried anyway in case the health checks are
+// wrong.
+func (uc *upstreamClient) pick(tried map[*upstreamEndpoint]bool, now time.Time) (*upstreamEndpoint, error) {
+	for _, eligible := range []func(ep *upstreamEndpoint) bool{
+		func(ep *upstreamEndpoint) bool { return ep.healthy.Load() && !tried[ep] },
+		func(ep *upstreamEndpoint) bool { return ep.healthy.Load() },
+		func(ep *upstreamEndpoint) bool { return true },
+	} {
+		var candidates []*upstreamEndpoint
+		for _, ep := range uc.endpoints {
+			if !eligible(ep) || !ep.breaker.available(now) {
+				continue
+			}
+			switch {
+			case len(candidates) == 0 || ep.Priority < candidates[0].Priority:
+				candidates = []*upstreamEndpoint{ep}
+			case ep.Priority == candidates[0].Priority:
+				candidates = append(candidates, ep)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		ep := pickByWeight(candidates)
+		err := ep.breaker.allow(now)
+		if err != nil {
+			return nil, err
+		}
+		return ep, nil
+	}
+	return nil, errAutographCircuitOpen
+}
+
+// pickByWeight returns one of the upstreams at random, proportionally
+// to their weight
+func pickByWeight(endpoints []*upstreamEndpoint) *upstreamEndpoint {
+	total := 0
+	for _, ep := range endpoints {
+		total += ep.Weight
+	}
+	n := rand.Intn(total)
+	for _, ep := range endpoints {
+		n -= ep.Weight
+		if n < 0 {
+			return ep
+		}
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+// do sends the requests returned by newRequest until one gets a
+// response or fails in a way that isn't safe to retry, at most
+// maxAttempts times. Retries go to another upstream when possible. A
+// new request is made for every attempt, so each one gets a fresh Hawk
+// authorization. Attempts and the backoff between them stop when ctx is
+// canceled.
+func (uc *upstreamClient) do(ctx context.Context, newRequest func(ctx context.Context, baseURL string) (*http.Request, error)) (resp *http.Response, err error) {
+	tried := make(map[*upstreamEndpoint]bool)
+	for attempt := 1; ; attempt++ {
+		var ep *upstreamEndpoint
+		ep, err = uc.pick(tried, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		tried[ep] = true
+		resp, err = uc.attempt(ctx, ep, newRequest)
+
+		var retryable bool
+		switch {
+		case err != nil:
+			retryable = isConnectError(err)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			retryable = isRetryableStatusCode(resp.StatusCode, resp.Request.Method)
+		default:
+			return resp, nil
+		}
+		if !retryable || attempt >= uc.maxAttempts {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("autograph returned status code %d", resp.StatusCode)
+		}
+		backoff := uc.backoff(attempt)
+		log.Warnf("autograph attempt %d of %d to %s failed, retrying in %s: %v", attempt, uc.maxAttempts, ep.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt sends a request to an upstream with a deadline of
+// attemptTimeout, which covers reading the response body, and records
+// the outcome in the circuit breaker of the upstream. Closing the body
+// of the response releases its deadline.
+func (uc *upstreamClient) attempt(ctx context.Context, ep *upstreamEndpoint, newRequest func(ctx context.Context, baseURL string) (*http.Request, error)) (*http.Response, error) {
+	// the outcome is recorded on every path, so a half-open trial
+	// request that wasn't sent doesn't keep the circuit open
+	outcome := ep.breaker.release
+	defer func() { outcome() }()
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	if uc.attemptTimeout > 0 {
+		attemptCtx, cancel = context.WithTimeout(ctx, uc.attemptTimeout)
+	}
+	req, err := newRequest(attemptCtx, ep.URL)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := uc.httpClient.Do(req)
+	observeUpstreamRequest(ep.URL, start, resp)
+	switch {
+	case err != nil:
+		cancel()
+		// requests canceled by the client aren't failures of autograph
+		if ctx.Err() == nil {
+			outcome = func() { ep.breaker.failure(time.Now()) }
+		}
+		return nil, err
+	case resp.StatusCode >= http.StatusInternalServerError:
+		outcome = func() { ep.breaker.failure(time.Now()) }
+	default:
+		outcome = ep.breaker.success
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose is a response body that cancels the context of its
+// request when it is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// backoff returns a random delay between half and all of the retry
+// backoff doubled for every previous attempt
+func (uc *upstreamClient) backoff(attempt int) time.Duration {
+	d := uc.retryBackoff << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isConnectError returns whether a request failed before reaching
+// autograph, in which case it is safe to retry. Requests that time out
+// waiting for a response may still be signing and aren't retried.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isRetryableStatusCode returns whether an autograph response status
+// code means a request with the method wasn't handled and can be
+// retried. A 502 or 504 from a proxy in front of autograph doesn't mean
+// autograph didn't sign, so those are only retried for idempotent
+// requests.
+func isRetryableStatusCode(code int, method string) bool {
+	switch code {
+	case http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == http.MethodGet || method == http.MethodHead
+	default:
+		return false
+	}
+}
+
+// validateUpstreamConfiguration returns an error for:
+//
+// both or neither of autograph_base_url and autograph_upstreams
+// an invalid upstream URL, or a negative upstream priority or weight
+// negative autograph timeouts, retry or circuit breaker settings
+func validateUpstreamConfiguration(c *configuration) error {
+	if c.BaseURL != "" && len(c.AutographUpstreams) > 0 {
+		return fmt.Errorf("only one of autograph_base_url and autograph_upstreams can be set")
+	}
+	for i, u := range c.upstreamConfigurations() {
+		err := validateBaseURL(u.URL)
+		if err != nil {
+			return fmt.Errorf("error validating autograph upstream %d: %v", i, err)
+		}
+		if u.Priority < 0 || u.Weight < 0 {
+			return fmt.Errorf("autograph upstream %d priority and weight cannot be negative", i)
+		}
+	}
+	for _, s := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"autograph_connect_timeout", c.AutographConnectTimeout},
+		{"autograph_response_timeout", c.AutographResponseTimeout},
+		{"autograph_attempt_timeout", c.AutographAttemptTimeout},
+		{"autograph_retry_backoff", c.AutographRetryBackoff},
+		{"autograph_circuit_breaker_cooldown", c.AutographCircuitBreakerCooldown},
+	} {
+		if s.value < 0 {
+			return fmt.Errorf("%s cannot be negative, got %s", s.name, s.value)
+		}
+	}
+	if c.AutographMaxAttempts < 0 {
+		return fmt.Errorf("autograph_max_attempts cannot be negative, got %d", c.AutographMaxAttempts)
+	}
+	if c.AutographCircuitBreakerThreshold < 0 {
+		return fmt.Errorf("autograph_circuit_breaker_threshold cannot be negative, got %d", c.AutographCircuitBreakerThreshold)
+	}
+	return nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreaker("http://localhost:8000/", 2, time.Minute)
+
+	cb.failure(now)
+	if err := cb.allow(now); err != nil || cb.status() != circuitClosed {
+		t.Fatalf("circuit is %s with allow() error %v after 1 failure, expected closed", cb.status(), err)
+	}
+	cb.failure(now)
+	if err := cb.allow(now); err != errAutographCircuitOpen || cb.status() != circuitOpen {
+		t.Fatalf("circuit is %s with allow() error %v after 2 failures, expected open", cb.status(), err)
+	}
+
+	// a single trial request is allowed after the cooldown
+	later := now.Add(time.Minute)
+	if err := cb.allow(later); err != nil || cb.status() != circuitHalfOpen {
+		t.Fatalf("circuit is %s with allow() error %v after the cooldown, expected half-open", cb.status(), err)
+	}
+	if err := cb.allow(later); err != errAutographCircuitOpen {
+		t.Fatalf("allow() error %v during the trial request, expected %v", err, errAutographCircuitOpen)
+	}
+	cb.failure(later)
+	if err := cb.allow(later); err != errAutographCircuitOpen || cb.status() != circuitOpen {
+		t.Fatalf("circuit is %s with allow() error %v after the trial failed, expected open", cb.status(), err)
+	}
+
+	evenLater := later.Add(time.Minute)
+	if err := cb.allow(evenLater); err != nil {
+		t.Fatalf("allow() error %v after the second cooldown", err)
+	}
+	cb.success()
+	if err := cb.allow(evenLater); err != nil || cb.status() != circuitClosed {
+		t.Fatalf("circuit is %s with allow() error %v after the trial succeeded, expected closed", cb.status(), err)
+	}
+}
+
+func TestUpstreamClientDo(t *testing.T) {
+	tests := []struct {
+		name             string
+		statusCodes      []int
+		maxAttempts      int
+		expectedStatus   int
+		expectedAttempts int
+		expectedBreaker  string
+	}{
+		{
+			name:             "success",
+			statusCodes:      []int{http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusCreated,
+			expectedAttempts: 1,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "retries 503 until success",
+			statusCodes:      []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusCreated,
+			expectedAttempts: 3,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "stops after max attempts",
+			statusCodes:      []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusCreated},
+			maxAttempts:      2,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 2,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "does not retry 500",
+			statusCodes:      []int{http.StatusInternalServerError, http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusInternalServerError,
+			expectedAttempts: 1,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "does not retry 502 sign requests",
+			statusCodes:      []int{http.StatusBadGateway, http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusBadGateway,
+			expectedAttempts: 1,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "does not retry 504 sign requests",
+			statusCodes:      []int{http.StatusGatewayTimeout, http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusGatewayTimeout,
+			expectedAttempts: 1,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "does not retry 4xx",
+			statusCodes:      []int{http.StatusUnauthorized, http.StatusCreated},
+			maxAttempts:      3,
+			expectedStatus:   http.StatusUnauthorized,
+			expectedAttempts: 1,
+			expectedBreaker:  circuitClosed,
+		},
+		{
+			name:             "opens the circuit breaker",
+			statusCodes:      []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			maxAttempts:      4,
+			expectedStatus:   0,
+			expectedAttempts: 3,
+			expectedBreaker:  circuitOpen,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu             sync.Mutex
+				attempts       int
+				authorizations = map[string]bool{}
+			)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				authorizations[r.Header.Get("Authorization")] = true
+				w.WriteHeader(tt.statusCodes[attempts])
+				attempts++
+			}))
+			defer upstream.Close()
+
+			savedConf := conf
+			defer func() { conf = savedConf }()
+			conf.BaseURL = upstream.URL + "/"
+			conf.AutographMaxAttempts = tt.maxAttempts
+			conf.AutographRetryBackoff = time.Millisecond
+			conf.AutographCircuitBreakerThreshold = 3
+			conf.AutographCircuitBreakerCooldown = time.Minute
+			uc := newUpstreamClient(conf)
+
+			resp, err := uc.do(context.Background(), func(ctx context.Context, baseURL string) (*http.Request, error) {
+				req, _, err := newAutographSignRequest(ctx, baseURL, conf.Authorizations[0], func() io.Reader { return strings.NewReader("[]") }, 2, "127.0.0.1")
+				return req, err
+			})
+			if tt.expectedStatus == 0 {
+				if err != errAutographCircuitOpen {
+					t.Fatalf("do() error = %v, expected %v", err, errAutographCircuitOpen)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("do() error = %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.expectedStatus {
+					t.Fatalf("do() returned status %d, expected %d", resp.StatusCode, tt.expectedStatus)
+				}
+			}
+			if attempts != tt.expectedAttempts {
+				t.Fatalf("do() made %d attempts, expected %d", attempts, tt.expectedAttempts)
+			}
+			if len(authorizations) != attempts {
+				t.Fatalf("do() reused hawk authorizations: %d unique for %d attempts", len(authorizations), attempts)
+			}
+			if uc.endpoints[0].breaker.status() != tt.expectedBreaker {
+				t.Fatalf("circuit breaker is %s, expected %s", uc.endpoints[0].breaker.status(), tt.expectedBreaker)
+			}
+		})
+	}
+}
+
+func Test_isRetryableStatusCode(t *testing.T) {
+	tests := []struct {
+		code     int
+		method   string
+		expected bool
+	}{
+		{http.StatusServiceUnavailable, http.MethodPost, true},
+		{http.StatusBadGateway, http.MethodPost, false},
+		{http.StatusGatewayTimeout, http.MethodPost, false},
+		{http.StatusInternalServerError, http.MethodPost, false},
+		{http.StatusServiceUnavailable, http.MethodGet, true},
+		{http.StatusBadGateway, http.MethodGet, true},
+		{http.StatusGatewayTimeout, http.MethodGet, true},
+		{http.StatusInternalServerError, http.MethodGet, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableStatusCode(tt.code, tt.method); got != tt.expected {
+			t.Errorf("isRetryableStatusCode(%d, %s) = %v expected %v", tt.code, tt.method, got, tt.expected)
+		}
+	}
+}
+
+func TestUpstreamClientDoRetriesConnectErrors(t *testing.T) {
+	// get the address of a closed port
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = upstream.URL + "/"
+	conf.AutographMaxAttempts = 2
+	conf.AutographRetryBackoff = time.Millisecond
+	conf.AutographCircuitBreakerThreshold = 2
+	conf.AutographCircuitBreakerCooldown = time.Minute
+	uc := newUpstreamClient(conf)
+
+	_, err := uc.do(context.Background(), func(ctx context.Context, baseURL string) (*http.Request, error) {
+		req, _, err := newAutographSignRequest(ctx, baseURL, conf.Authorizations[0], func() io.Reader { return strings.NewReader("[]") }, 2, "127.0.0.1")
+		return req, err
+	})
+	if !isConnectError(err) {
+		t.Fatalf("do() error = %v, expected a connect error", err)
+	}
+	// both attempts count towards the threshold
+	if uc.endpoints[0].breaker.status() != circuitOpen {
+		t.Fatalf("circuit breaker is %s after 2 failed attempts, expected open", uc.endpoints[0].breaker.status())
+	}
+}
+
+func TestUpstreamClientDoReleasesTrial(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = upstream.URL + "/"
+	conf.AutographMaxAttempts = 1
+	conf.AutographCircuitBreakerThreshold = 1
+	conf.AutographCircuitBreakerCooldown = time.Minute
+	uc := newUpstreamClient(conf)
+	breaker := uc.endpoints[0].breaker
+	breaker.failure(time.Now().Add(-time.Hour))
+
+	// a half-open trial that can't be sent doesn't keep the circuit open
+	_, err := uc.do(context.Background(), func(ctx context.Context, baseURL string) (*http.Request, error) {
+		return nil, errors.New("failed to make request")
+	})
+	if err == nil || err == errAutographCircuitOpen {
+		t.Fatalf("do() error = %v, expected the request error", err)
+	}
+	if breaker.status() != circuitHalfOpen || !breaker.available(time.Now()) {
+		t.Fatalf("circuit is %s and unavailable after a trial request that wasn't sent", breaker.status())
+	}
+	resp, err := uc.do(context.Background(), func(ctx context.Context, baseURL string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"sign/file", nil)
+	})
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	resp.Body.Close()
+	if breaker.status() != circuitClosed {
+		t.Fatalf("circuit is %s after the trial succeeded, expected closed", breaker.status())
+	}
+}
+
+func TestUpstreamClientDoDeadlines(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable/sign/file" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// send the headers, then stall the body
+		w.WriteHeader(http.StatusCreated)
+		w.(http.Flusher).Flush()
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = upstream.URL + "/"
+	conf.AutographAttemptTimeout = 50 * time.Millisecond
+	conf.AutographMaxAttempts = 2
+	conf.AutographRetryBackoff = time.Hour
+	conf.AutographCircuitBreakerThreshold = 5
+	uc := newUpstreamClient(conf)
+	newRequest := func(path string) func(ctx context.Context, baseURL string) (*http.Request, error) {
+		return func(ctx context.Context, baseURL string) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodPost, baseURL+path, nil)
+		}
+	}
+
+	// the attempt timeout bounds reading a stalled response body
+	resp, err := uc.do(context.Background(), newRequest("sign/file"))
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("reading a stalled body error = %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// canceling the request stops the backoff between attempts
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = uc.do(ctx, newRequest("unavailable/sign/file"))
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Minute {
+		t.Fatalf("do() error = %v after %s, expected %v", err, time.Since(start), context.DeadlineExceeded)
+	}
+}
+
+func TestUpstreamClientFailover(t *testing.T) {
+	var primaryAttempts, secondaryAttempts int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryAttempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryAttempts++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer secondary.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = ""
+	conf.AutographUpstreams = []upstreamConfiguration{
+		{URL: secondary.URL + "/", Priority: 1},
+		{URL: primary.URL + "/"},
+	}
+	conf.AutographMaxAttempts = 3
+	conf.AutographRetryBackoff = time.Millisecond
+	conf.AutographCircuitBreakerThreshold = 1
+	conf.AutographCircuitBreakerCooldown = time.Minute
+	uc := newUpstreamClient(conf)
+
+	newRequest := func(ctx context.Context, baseURL string) (*http.Request, error) {
+		req, _, err := newAutographSignRequest(ctx, baseURL, conf.Authorizations[0], func() io.Reader { return strings.NewReader("[]") }, 2, "127.0.0.1")
+		return req, err
+	}
+	// the failed attempt to the primary is retried on the secondary
+	resp, err := uc.do(context.Background(), newRequest)
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || primaryAttempts != 1 || secondaryAttempts != 1 {
+		t.Fatalf("do() returned %d after %d primary and %d secondary attempts, expected 201 after 1 each",
+			resp.StatusCode, primaryAttempts, secondaryAttempts)
+	}
+	// the primary circuit is open, requests go to the secondary
+	resp, err = uc.do(context.Background(), newRequest)
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	resp.Body.Close()
+	if primaryAttempts != 1 || secondaryAttempts != 2 {
+		t.Fatalf("do() made %d primary and %d secondary attempts, expected 1 and 2", primaryAttempts, secondaryAttempts)
+	}
+}
+
+func TestUpstreamClientPick(t *testing.T) {
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = ""
+	conf.AutographUpstreams = []upstreamConfiguration{
+		{URL: "http://primary-a/", Weight: 3},
+		{URL: "http://primary-b/", Weight: 1},
+		{URL: "http://secondary/", Priority: 1},
+	}
+	conf.AutographCircuitBreakerThreshold = 1
+	conf.AutographCircuitBreakerCooldown = time.Minute
+	uc := newUpstreamClient(conf)
+	now := time.Now()
+
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ep, err := uc.pick(nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[ep.URL]++
+	}
+	if picked["http://secondary/"] != 0 {
+		t.Fatalf("picked the secondary %d times while the primaries are healthy", picked["http://secondary/"])
+	}
+	if picked["http://primary-a/"] < 2*picked["http://primary-b/"] {
+		t.Fatalf("picked primary-a %d times and primary-b %d times, expected about 3 times as often", picked["http://primary-a/"], picked["http://primary-b/"])
+	}
+
+	// unhealthy upstreams are skipped
+	uc.endpoints[0].setHealthy(false, nil)
+	uc.endpoints[1].setHealthy(false, nil)
+	ep, err := uc.pick(nil, now)
+	if err != nil || ep.URL != "http://secondary/" {
+		t.Fatalf("pick() = %v, %v with unhealthy primaries, expected the secondary", ep, err)
+	}
+
+	// unhealthy upstreams are used when the others' circuits are open
+	uc.endpoints[2].breaker.failure(now)
+	ep, err = uc.pick(nil, now)
+	if err != nil || ep.Priority != 0 {
+		t.Fatalf("pick() = %v, %v with an open secondary, expected a primary", ep, err)
+	}
+
+	// and requests fail when all circuits are open
+	uc.endpoints[0].breaker.failure(now)
+	uc.endpoints[1].breaker.failure(now)
+	_, err = uc.pick(nil, now)
+	if err != errAutographCircuitOpen {
+		t.Fatalf("pick() error = %v with all circuits open, expected %v", err, errAutographCircuitOpen)
+	}
+}
+
+func TestHeartbeatMultipleUpstreams(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = ""
+	conf.AutographUpstreams = []upstreamConfiguration{{URL: down.URL + "/"}, {URL: up.URL + "/"}}
+	conf.upstream = newUpstreamClient(conf)
+
+	w := httptest.NewRecorder()
+	heartbeatHandler(conf.upstream)(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("heartbeat returned %d with one healthy upstream, expected %d", w.Code, http.StatusOK)
+	}
+	if conf.upstream.endpoints[0].healthy.Load() || !conf.upstream.endpoints[1].healthy.Load() {
+		t.Fatalf("heartbeat did not record the health of the upstreams")
+	}
+
+	// the background check probes every upstream too
+	conf.upstream.endpoints[0].setHealthy(true, nil)
+	conf.upstream.checkHealth()
+	if conf.upstream.endpoints[0].healthy.Load() {
+		t.Fatalf("checkHealth did not mark the failing upstream unhealthy")
+	}
+}
+
+func Test_validateUpstreamConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    configuration
+		wantErr bool
+	}{
+		{
+			name:    "base URL",
+			conf:    configuration{BaseURL: "http://localhost:8000/"},
+			wantErr: false,
+		},
+		{
+			name: "upstreams",
+			conf: configuration{AutographUpstreams: []upstreamConfiguration{
+				{URL: "http://us-west/", Weight: 2},
+				{URL: "http://us-east/", Priority: 1},
+			}},
+			wantErr: false,
+		},
+		{
+			name:    "neither base URL nor upstreams",
+			conf:    configuration{},
+			wantErr: true,
+		},
+		{
+			name: "both base URL and upstreams",
+			conf: configuration{
+				BaseURL:            "http://localhost:8000/",
+				AutographUpstreams: []upstreamConfiguration{{URL: "http://us-west/"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "upstream without trailing slash",
+			conf:    configuration{AutographUpstreams: []upstreamConfiguration{{URL: "http://us-west"}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative weight",
+			conf:    configuration{AutographUpstreams: []upstreamConfiguration{{URL: "http://us-west/", Weight: -1}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative timeout",
+			conf:    configuration{BaseURL: "http://localhost:8000/", AutographResponseTimeout: -time.Second},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateUpstreamConfiguration(&tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("validateUpstreamConfiguration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
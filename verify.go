@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// validateSignatureVerification checks that the roots add-on signatures
+// are verified against are set when signatures are verified and an
+// authorization signs add-ons
+func validateSignatureVerification(c *configuration) error {
+	if c.AddonRootCerts != "" || !c.VerifySignatures {
+		return nil
+	}
+	for i, auth := range c.Authorizations {
+		if auth.AddonID != "" {
+			return fmt.Errorf("auth %d signs add-ons but verify_signatures is set without addon_root_certs", i)
+		}
+	}
+	return nil
+}
+
+// loadAddonRoots loads the roots add-on signatures are verified
+// against, if any
+func loadAddonRoots(c *configuration) error {
+	if c.AddonRootCerts == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.AddonRootCerts)
+	if err != nil {
+		return errors.Wrap(err, "failed to read add-on root certificates")
+	}
+	c.addonRoots = x509.NewCertPool()
+	if !c.addonRoots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in add-on root certificates %q", c.AddonRootCerts)
+	}
+	return nil
+}
+
+// verifySignedFile checks the signatures of a file autograph signed
+// for an authorization, and that it has the content of the input: XPIs
+// for authorizations with an add-on ID, and APKs for the others
+func verifySignedFile(auth authorization, input, signed *io.SectionReader, addonRoots *x509.CertPool) error {
+	var err error
+	if auth.AddonID != "" {
+		err = verifyXPISignatures(input, signed, auth, addonRoots)
+	} else {
+		err = verifyAPKSignatures(input, signed)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSignatureVerification, err)
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mozilla.org/pkcs7"
+)
+
+// makeTestJARManifest returns a JAR manifest listing the SHA-256
+// digests of files, sorted for stable output
+func makeTestJARManifest(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifest := "Manifest-Version: 1.0\n\n"
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(files[name]))
+		manifest += fmt.Sprintf("Name: %s\nSHA-256-Digest: %s\n\n", name, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return manifest
+}
+
+// makeTestJARSignature returns a signature file for a manifest and its
+// detached PKCS7 signature
+func makeTestJARSignature(t *testing.T, manifest string, cert *x509.Certificate, key *ecdsa.PrivateKey) (sf string, block []byte) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(manifest))
+	sf = "Signature-Version: 1.0\nSHA-256-Digest-Manifest: " + base64.StdEncoding.EncodeToString(sum[:]) + "\n\n"
+	sd, err := pkcs7.NewSignedData([]byte(sf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	block, err = sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sf, block
+}
+
+// makeTestCOSESignature returns an ES256 COSE_Sign message over the
+// payload signed by key with cert as end-entity certificate
+func makeTestCOSESignature(t *testing.T, payload []byte, cert *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	bodyProtected, err := cbor.Marshal(map[int][][]byte{coseHeaderKid: {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signProtected, err := cbor.Marshal(map[int]interface{}{coseHeaderAlg: -7, coseHeaderKid: cert.Raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	toBeSigned, err := cbor.Marshal([]interface{}{"Signature", bodyProtected, signProtected, []byte{}, payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(toBeSigned)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	msg := coseSignMessage{
+		Protected:   bodyProtected,
+		Unprotected: cbor.RawMessage{0xa0},
+		Signatures: []coseSignature{{
+			Protected:   signProtected,
+			Unprotected: cbor.RawMessage{0xa0},
+			Signature:   signature,
+		}},
+	}
+	content, err := cbor.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := cbor.Marshal(cbor.RawTag{Number: coseSignTag, Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// makeTestSignedXPI returns an XPI of files with PKCS7 and, when cose
+// is set, COSE signatures
+func makeTestSignedXPI(t *testing.T, files map[string]string, cose bool, cert *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	signed := make(map[string]string)
+	for name, content := range files {
+		signed[name] = content
+	}
+	if cose {
+		coseManifest := makeTestJARManifest(files)
+		signed["META-INF/cose.manifest"] = coseManifest
+		signed["META-INF/cose.sig"] = string(makeTestCOSESignature(t, []byte(coseManifest), cert, key))
+	}
+	manifest := makeTestJARManifest(signed)
+	sf, block := makeTestJARSignature(t, manifest, cert, key)
+	signed["META-INF/manifest.mf"] = manifest
+	signed["META-INF/mozilla.sf"] = sf
+	signed["META-INF/mozilla.rsa"] = string(block)
+	return makeZip(t, signed)
+}
+
+// makeTestSignedAPKV1 returns an APK of files with a JAR signature
+func makeTestSignedAPKV1(t *testing.T, files map[string]string, cert *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	signed := make(map[string]string)
+	for name, content := range files {
+		signed[name] = content
+	}
+	manifest := makeTestJARManifest(files)
+	sf, block := makeTestJARSignature(t, manifest, cert, key)
+	signed["META-INF/MANIFEST.MF"] = manifest
+	signed["META-INF/CERT.SF"] = sf
+	signed["META-INF/CERT.EC"] = string(block)
+	return makeZip(t, signed)
+}
+
+// appendLengthPrefixed appends values to b each prefixed with their
+// little endian uint32 length
+func appendLengthPrefixed(b []byte, values ...[]byte) []byte {
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// addTestAPKSignatureSchemeV2 returns the APK with an APK Signature
+// Scheme v2 block signed by key with ECDSA with SHA2-256
+func addTestAPKSignatureSchemeV2(t *testing.T, apk []byte, cert *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	eocdOffset := int64(len(apk) - zipEOCDMinSize)
+	cdOffset := int64(binary.LittleEndian.Uint32(apk[eocdOffset+16:]))
+	// the content digest covers the end of central directory pointing
+	// to the signing block, which will start where the central
+	// directory currently does
+	digest, err := apkContentDigest(sectionReader(apk), &apkSigningBlock{
+		offset:                 cdOffset,
+		centralDirectoryOffset: cdOffset,
+		eocdOffset:             eocdOffset,
+		eocd:                   apk[eocdOffset:],
+	}, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ecdsaSHA256 = 0x0201
+	digests := appendLengthPrefixed(nil, appendLengthPrefixed(binary.LittleEndian.AppendUint32(nil, ecdsaSHA256), digest))
+	signedData := appendLengthPrefixed(nil,
+		digests,
+		appendLengthPrefixed(nil, cert.Raw),
+		nil,
+	)
+	sum := sha256.Sum256(signedData)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures := appendLengthPrefixed(nil, appendLengthPrefixed(binary.LittleEndian.AppendUint32(nil, ecdsaSHA256), signature))
+	signer := appendLengthPrefixed(nil, signedData, signatures, cert.RawSubjectPublicKeyInfo)
+	value := appendLengthPrefixed(nil, appendLengthPrefixed(nil, signer))
+
+	pair := binary.LittleEndian.AppendUint32(nil, apkSignatureSchemeV2BlockID)
+	pair = append(pair, value...)
+	pairs := binary.LittleEndian.AppendUint64(nil, uint64(len(pair)))
+	pairs = append(pairs, pair...)
+	size := uint64(len(pairs) + 24)
+	block := binary.LittleEndian.AppendUint64(nil, size)
+	block = append(block, pairs...)
+	block = binary.LittleEndian.AppendUint64(block, size)
+	block = append(block, apkSigningBlockMagic...)
+
+	var signed []byte
+	signed = append(signed, apk[:cdOffset]...)
+	signed = append(signed, block...)
+	signed = append(signed, apk[cdOffset:]...)
+	binary.LittleEndian.PutUint32(signed[len(signed)-zipEOCDMinSize+16:], uint32(cdOffset)+uint32(len(block)))
+	return signed
+}
+
+func TestVerifySignedFile(t *testing.T) {
+	root, rootKey := makeTestCert(t, "test root", nil, nil)
+	otherRoot, otherRootKey := makeTestCert(t, "other root", nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	const addonID = "myaddon@allizom.org"
+	addonCert, addonKey := makeTestCert(t, addonID, root, rootKey)
+	otherAddonCert, otherAddonKey := makeTestCert(t, "otheraddon@allizom.org", root, rootKey)
+	untrustedCert, untrustedKey := makeTestCert(t, addonID, otherRoot, otherRootKey)
+	apkCert, apkKey := makeTestCert(t, "testapp", nil, nil)
+
+	xpiFiles := map[string]string{
+		"manifest.json": `{"browser_specific_settings": {"gecko": {"id": "myaddon@allizom.org"}}}`,
+		"background.js": "console.log('hello')",
+	}
+	apkFiles := map[string]string{
+		"AndroidManifest.xml": "binary manifest",
+		"classes.dex":         "dex",
+	}
+	xpiAuth := authorization{AddonID: addonID}
+	coseAuth := authorization{AddonID: addonID, AddonCOSEAlgorithms: []string{"ES256"}}
+	apkAuth := authorization{}
+
+	tamperedFiles := func(files map[string]string) map[string]string {
+		tampered := map[string]string{"injected.js": "evil"}
+		for name, content := range files {
+			tampered[name] = content
+		}
+		return tampered
+	}
+	apkV1 := makeTestSignedAPKV1(t, apkFiles, apkCert, apkKey)
+	tamperedV2 := addTestAPKSignatureSchemeV2(t, makeZip(t, apkFiles), apkCert, apkKey)
+	// flip a bit of the signature, the last value of the block
+	sigEnd := bytes.Index(tamperedV2, []byte(apkSigningBlockMagic)) - 8 - len(apkCert.RawSubjectPublicKeyInfo) - 4 - 1
+	tamperedV2[sigEnd] ^= 1
+
+	tests := []struct {
+		name      string
+		auth      authorization
+		input     []byte
+		signed    []byte
+		expectErr string
+	}{
+		{
+			name:   "signed XPI",
+			auth:   xpiAuth,
+			input:  makeZip(t, xpiFiles),
+			signed: makeTestSignedXPI(t, xpiFiles, false, addonCert, addonKey),
+		},
+		{
+			name:   "signed XPI with COSE signature",
+			auth:   coseAuth,
+			input:  makeZip(t, xpiFiles),
+			signed: makeTestSignedXPI(t, xpiFiles, true, addonCert, addonKey),
+		},
+		{
+			name:      "XPI missing the requested COSE signature",
+			auth:      coseAuth,
+			input:     makeZip(t, xpiFiles),
+			signed:    makeTestSignedXPI(t, xpiFiles, false, addonCert, addonKey),
+			expectErr: "missing COSE signature files",
+		},
+		{
+			name:      "unsigned XPI",
+			auth:      xpiAuth,
+			input:     makeZip(t, xpiFiles),
+			signed:    makeZip(t, xpiFiles),
+			expectErr: "missing PKCS7 signature files",
+		},
+		{
+			name:      "XPI signed for another add-on",
+			auth:      xpiAuth,
+			input:     makeZip(t, xpiFiles),
+			signed:    makeTestSignedXPI(t, xpiFiles, false, otherAddonCert, otherAddonKey),
+			expectErr: `PKCS7 signature is not for add-on "myaddon@allizom.org"`,
+		},
+		{
+			name:      "XPI signed by an untrusted root",
+			auth:      xpiAuth,
+			input:     makeZip(t, xpiFiles),
+			signed:    makeTestSignedXPI(t, xpiFiles, false, untrustedCert, untrustedKey),
+			expectErr: "invalid PKCS7 signature",
+		},
+		{
+			name:      "XPI with a file added",
+			auth:      xpiAuth,
+			input:     makeZip(t, xpiFiles),
+			signed:    makeTestSignedXPI(t, tamperedFiles(xpiFiles), false, addonCert, addonKey),
+			expectErr: "signed file contains injected.js which is not in the input",
+		},
+		{
+			name:   "APK with a v1 signature",
+			auth:   apkAuth,
+			input:  makeZip(t, apkFiles),
+			signed: apkV1,
+		},
+		{
+			name:   "APK with a v2 signature",
+			auth:   apkAuth,
+			input:  makeZip(t, apkFiles),
+			signed: addTestAPKSignatureSchemeV2(t, makeZip(t, apkFiles), apkCert, apkKey),
+		},
+		{
+			name:   "APK with v1 and v2 signatures",
+			auth:   apkAuth,
+			input:  makeZip(t, apkFiles),
+			signed: addTestAPKSignatureSchemeV2(t, apkV1, apkCert, apkKey),
+		},
+		{
+			name:      "APK with an invalid v2 signature",
+			auth:      apkAuth,
+			input:     makeZip(t, apkFiles),
+			signed:    tamperedV2,
+			expectErr: "invalid v2 signature",
+		},
+		{
+			name:      "unsigned APK",
+			auth:      apkAuth,
+			input:     makeZip(t, apkFiles),
+			signed:    makeZip(t, apkFiles),
+			expectErr: "APK is not signed",
+		},
+		{
+			name:      "APK with a file added",
+			auth:      apkAuth,
+			input:     makeZip(t, apkFiles),
+			signed:    makeTestSignedAPKV1(t, tamperedFiles(apkFiles), apkCert, apkKey),
+			expectErr: "signed file contains injected.js which is not in the input",
+		},
+		{
+			name:      "not a zip",
+			auth:      apkAuth,
+			input:     makeZip(t, apkFiles),
+			signed:    []byte("signed"),
+			expectErr: "failed to read zip archive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignedFile(tt.auth, sectionReader(tt.input), sectionReader(tt.signed), roots)
+			if tt.expectErr == "" {
+				if err != nil {
+					t.Fatalf("verifySignedFile() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errSignatureVerification) || !strings.Contains(err.Error(), tt.expectErr) {
+				t.Fatalf("verifySignedFile() error = %v, expected %q", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+func Test_parseJARManifest(t *testing.T) {
+	main, entries, err := parseJARManifest([]byte("Manifest-Version: 1.0\r\nCreated-By: 1.0 (Android)\r\n\r\n" +
+		"Name: res/a_very_long_directory_name_that_does_not_fit_on_a_single_line/\r\n icon.png\r\nSHA-256-Digest: abc=\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main["Created-By"] != "1.0 (Android)" {
+		t.Fatalf("main section = %v", main)
+	}
+	name := "res/a_very_long_directory_name_that_does_not_fit_on_a_single_line/icon.png"
+	if entries[name]["SHA-256-Digest"] != "abc=" {
+		t.Fatalf("entries = %v expected a digest of %s", entries, name)
+	}
+
+	for _, manifest := range []string{
+		"",
+		"Manifest-Version: 1.0\n\nSHA-256-Digest: abc=\n",
+		"Manifest-Version: 1.0\n\nName: a\n\nName: a\n",
+		" continued\n",
+		"not an attribute\n",
+	} {
+		_, _, err = parseJARManifest([]byte(manifest))
+		if err == nil {
+			t.Fatalf("parseJARManifest(%q) expected an error", manifest)
+		}
+	}
+}
+
+func Test_isAPKSignatureFile(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"META-INF/MANIFEST.MF":   true,
+		"META-INF/CERT.SF":       true,
+		"META-INF/cert.rsa":      true,
+		"META-INF/CERT.EC":       true,
+		"META-INF/SIG-FOO":       true,
+		"META-INF/services/a.SF": false,
+		"META-INF/kotlin.module": false,
+		"classes.dex":            false,
+	} {
+		if isAPKSignatureFile(name) != expected {
+			t.Errorf("isAPKSignatureFile(%q) = %v expected %v", name, !expected, expected)
+		}
+	}
+}
+
+func Test_validateSignatureVerification(t *testing.T) {
+	root, _ := makeTestCert(t, "test root", nil, nil)
+	dir := t.TempDir()
+	rootsPath := filepath.Join(dir, "roots.pem")
+	err := os.WriteFile(rootsPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(dir, "empty.pem")
+	err = os.WriteFile(emptyPath, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addonAuth := []authorization{{AddonID: "myaddon@allizom.org"}}
+	apkAuth := []authorization{{Signer: "testapp-android"}}
+
+	tests := []struct {
+		name      string
+		c         configuration
+		expectErr bool
+	}{
+		{"disabled", configuration{Authorizations: addonAuth}, false},
+		{"APK only", configuration{VerifySignatures: true, Authorizations: apkAuth}, false},
+		{"add-ons without roots", configuration{VerifySignatures: true, Authorizations: addonAuth}, true},
+		{"add-ons with roots", configuration{VerifySignatures: true, AddonRootCerts: rootsPath, Authorizations: addonAuth}, false},
+		{"missing roots", configuration{VerifySignatures: true, AddonRootCerts: filepath.Join(dir, "missing.pem")}, true},
+		{"empty roots", configuration{VerifySignatures: true, AddonRootCerts: emptyPath}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSignatureVerification(&tt.c)
+			if err == nil {
+				err = loadAddonRoots(&tt.c)
+			}
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("validateSignatureVerification() and loadAddonRoots() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.c.AddonRootCerts != "" && err == nil && tt.c.addonRoots == nil {
+				t.Fatalf("loadAddonRoots() did not load the roots")
+			}
+		})
+	}
+}
+
+func TestSigHandlerVerifySignatures(t *testing.T) {
+	auth := conf.Authorizations[2]
+	autograph := newTestAutograph(t, auth, testAutographResponse{})
+	defer autograph.Close()
+
+	savedConf := conf
+	defer func() { conf = savedConf }()
+	conf.BaseURL = autograph.URL + "/"
+	conf.AutographMaxAttempts = 1
+	conf.upstream = newUpstreamClient(conf)
+
+	// the test autograph returns the unsigned input
+	input := makeZip(t, map[string]string{"classes.dex": "dex"})
+	for _, verify := range []bool{false, true} {
+		conf.VerifySignatures = verify
+		before := testutil.ToFloat64(signatureVerificationFailures.WithLabelValues(auth.User, auth.Signer))
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("input", "app.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(input)
+		mw.Close()
+		r := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", auth.ClientToken)
+		w := httptest.NewRecorder()
+		sigHandler(w, r)
+
+		expectedCode, expectedFailures := http.StatusCreated, before
+		if verify {
+			expectedCode, expectedFailures = http.StatusBadGateway, before+1
+		}
+		if w.Code != expectedCode {
+			t.Fatalf("sigHandler with verify_signatures %v returned %d expected %d", verify, w.Code, expectedCode)
+		}
+		if verify && !strings.Contains(w.Body.String(), errSignatureVerification.Error()) {
+			t.Fatalf("sigHandler returned %q expected %q", w.Body.String(), errSignatureVerification)
+		}
+		failures := testutil.ToFloat64(signatureVerificationFailures.WithLabelValues(auth.User, auth.Signer))
+		if failures != expectedFailures {
+			t.Fatalf("signature verification failures went from %v to %v expected %v", before, failures, expectedFailures)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	// maxXPIManifestSize is the largest manifest.json or install.rdf
+	// we're willing to decompress to find the add-on ID
+	maxXPIManifestSize = 1 << 20
+
+	// emRDFNamespace is the XML namespace of the extension manifest
+	// properties in a legacy install.rdf
+	emRDFNamespace = "http://www.mozilla.org/2004/em-rdf#"
+
+	// installManifestAbout is the about attribute of the install.rdf
+	// Description holding the add-on properties
+	installManifestAbout = "urn:mozilla:install-manifest"
+)
+
+// manifestCommentLine matches the lines starting with a // comment that
+// Firefox removes from manifest.json before parsing it
+var manifestCommentLine = regexp.MustCompile(`(?m)^\s*//.*`)
+
+// webExtensionManifest contains the fields of a WebExtension
+// manifest.json that can declare an add-on ID
+type webExtensionManifest struct {
+	BrowserSpecificSettings *geckoSettings `json:"browser_specific_settings"`
+	Applications            *geckoSettings `json:"applications"`
+}
+
+type geckoSettings struct {
+	Gecko *struct {
+		ID string `json:"id"`
+	} `json:"gecko"`
+}
+
+func (s *geckoSettings) geckoID() string {
+	if s == nil || s.Gecko == nil {
+		return ""
+	}
+	return s.Gecko.ID
+}
+
+// readXPIFile returns the decompressed content of the named file in
+// the XPI or nil when the XPI does not contain it
+func readXPIFile(xpi *zip.Reader, name string) ([]byte, error) {
+	for _, f := range xpi.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", name)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, maxXPIManifestSize+1))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", name)
+		}
+		if len(data) > maxXPIManifestSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes", name, maxXPIManifestSize)
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+// parseManifestJSONAddonID returns the gecko ID declared in a
+// WebExtension manifest.json, preferring browser_specific_settings
+// over the deprecated applications key. Like Firefox, it ignores lines
+// that start with a // comment.
+func parseManifestJSONAddonID(data []byte) (string, error) {
+	var manifest webExtensionManifest
+	data = manifestCommentLine.ReplaceAll(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), nil)
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse manifest.json")
+	}
+	if id := manifest.BrowserSpecificSettings.geckoID(); id != "" {
+		return id, nil
+	}
+	return manifest.Applications.geckoID(), nil
+}
+
+// isInstallManifest returns whether an element is the install.rdf
+// Description of the add-on itself (rather than e.g. one of its
+// target applications)
+func isInstallManifest(start xml.StartElement) bool {
+	if start.Name.Local != "Description" {
+		return false
+	}
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "about" && attr.Value == installManifestAbout {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInstallRDFAddonID returns the em:id of the install manifest
+// in a legacy install.rdf. The ID can be set either as an attribute
+// of the Description element or as a child element.
+func parseInstallRDFAddonID(data []byte) (string, error) {
+	var (
+		dec           = xml.NewDecoder(bytes.NewReader(data))
+		depth         int
+		manifestDepth = -1
+		inID          bool
+		id            bytes.Buffer
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "failed to parse install.rdf")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if manifestDepth == -1 && isInstallManifest(t) {
+				manifestDepth = depth
+				for _, attr := range t.Attr {
+					if attr.Name.Space == emRDFNamespace && attr.Name.Local == "id" {
+						return attr.Value, nil
+					}
+				}
+			} else if depth == manifestDepth+1 && t.Name.Space == emRDFNamespace && t.Name.Local == "id" {
+				inID = true
+			}
+		case xml.CharData:
+			if inID {
+				id.Write(t)
+			}
+		case xml.EndElement:
+			if inID {
+				return string(bytes.TrimSpace(id.Bytes())), nil
+			}
+			if depth == manifestDepth {
+				return "", nil
+			}
+			depth--
+		}
+	}
+}
+
+// readXPIAddonID returns the add-on ID declared in an XPI's
+// manifest.json or, for legacy add-ons, its install.rdf. It returns
+// an empty string when the XPI does not declare an ID.
+func readXPIAddonID(input *io.SectionReader) (string, error) {
+	xpi, err := zip.NewReader(input, input.Size())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read zip archive")
+	}
+	manifest, err := readXPIFile(xpi, "manifest.json")
+	if err != nil {
+		return "", err
+	}
+	if manifest != nil {
+		return parseManifestJSONAddonID(manifest)
+	}
+	rdf, err := readXPIFile(xpi, "install.rdf")
+	if err != nil {
+		return "", err
+	}
+	if rdf != nil {
+		return parseInstallRDFAddonID(rdf)
+	}
+	return "", errXPIMissingManifest
+}
+
+// validateXPIAddonID returns an error when the XPI cannot be parsed
+// or declares an add-on ID other than the authorized one. XPIs that
+// do not declare an ID are accepted since autograph sets it from the
+// authorization.
+func validateXPIAddonID(input *io.SectionReader, addonID string) error {
+	id, err := readXPIAddonID(input)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errXPIInvalid, err)
+	}
+	if id != "" && id != addonID {
+		return fmt.Errorf("%w: found %q expected %q", errXPIAddonIDMismatch, id, addonID)
+	}
+	return nil
+}
+
+// xpiSignatureFiles are the files signing adds to an XPI: a JAR
+// manifest with its PKCS7 signed signature file, and optionally a
+// manifest with a COSE signature
+var xpiSignatureFiles = map[string]bool{
+	"META-INF/manifest.mf":   true,
+	"META-INF/mozilla.sf":    true,
+	"META-INF/mozilla.rsa":   true,
+	"META-INF/cose.manifest": true,
+	"META-INF/cose.sig":      true,
+}
+
+func isXPISignatureFile(name string) bool {
+	return xpiSignatureFiles[name]
+}
+
+// verifyXPISignatures checks that a signed XPI contains the files of
+// the input, that its PKCS7 signature, and COSE signatures when the
+// authorization requests them, chain to one of the roots with an
+// end-entity certificate for the add-on ID, and that the signed
+// manifests cover all its files
+func verifyXPISignatures(input, signed *io.SectionReader, auth authorization, roots *x509.CertPool) error {
+	inputContents, err := readZipContents(input, isXPISignatureFile)
+	if err != nil {
+		return err
+	}
+	contents, err := readZipContents(signed, isXPISignatureFile)
+	if err != nil {
+		return err
+	}
+	err = compareZipContents(inputContents, contents)
+	if err != nil {
+		return err
+	}
+
+	manifest, sf, rsa := contents.signatureFiles["META-INF/manifest.mf"],
+		contents.signatureFiles["META-INF/mozilla.sf"],
+		contents.signatureFiles["META-INF/mozilla.rsa"]
+	if manifest == nil || sf == nil || rsa == nil {
+		return fmt.Errorf("missing PKCS7 signature files")
+	}
+	p7, err := pkcs7.Parse(rsa)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse PKCS7 signature")
+	}
+	p7.Content = sf
+	err = p7.VerifyWithChain(roots)
+	if err != nil {
+		return errors.Wrap(err, "invalid PKCS7 signature")
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil || signer.Subject.CommonName != auth.AddonID {
+		return fmt.Errorf("PKCS7 signature is not for add-on %q", auth.AddonID)
+	}
+	err = verifyJARSignatureFile(sf, manifest)
+	if err != nil {
+		return errors.Wrap(err, "invalid META-INF/mozilla.sf")
+	}
+	_, entries, err := parseJARManifest(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse META-INF/manifest.mf")
+	}
+	err = verifyJARManifest(contents, "META-INF/manifest.mf", entries, func(name string) bool {
+		return name == "META-INF/manifest.mf" || name == "META-INF/mozilla.sf" || name == "META-INF/mozilla.rsa"
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(auth.AddonCOSEAlgorithms) == 0 {
+		return nil
+	}
+	coseManifest, coseSig := contents.signatureFiles["META-INF/cose.manifest"], contents.signatureFiles["META-INF/cose.sig"]
+	if coseManifest == nil || coseSig == nil {
+		return fmt.Errorf("missing COSE signature files")
+	}
+	signers, err := verifyCOSESignatures(coseSig, coseManifest, roots)
+	if err != nil {
+		return err
+	}
+	signedAlgorithms := make(map[string]bool)
+	for _, signer := range signers {
+		if signer.cert.Subject.CommonName != auth.AddonID {
+			return fmt.Errorf("%s COSE signature is not for add-on %q", signer.algorithm, auth.AddonID)
+		}
+		signedAlgorithms[signer.algorithm] = true
+	}
+	for _, algorithm := range auth.AddonCOSEAlgorithms {
+		if !signedAlgorithms[algorithm] {
+			return fmt.Errorf("missing %s COSE signature", algorithm)
+		}
+	}
+	_, entries, err = parseJARManifest(coseManifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse META-INF/cose.manifest")
+	}
+	return verifyJARManifest(contents, "META-INF/cose.manifest", entries, isXPISignatureFile)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// makeZip returns a zip archive containing the provided files
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sectionReader returns a reader of data like the ones of spooled files
+func sectionReader(data []byte) *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+}
+
+const testInstallRDFAttr = `<?xml version="1.0"?>
+<RDF xmlns="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+     xmlns:em="http://www.mozilla.org/2004/em-rdf#">
+  <Description about="urn:mozilla:install-manifest"
+               em:id="legacy@allizom.org"
+               em:version="1.0"/>
+</RDF>`
+
+const testInstallRDFElement = `<?xml version="1.0"?>
+<RDF:RDF xmlns:RDF="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+         xmlns:em="http://www.mozilla.org/2004/em-rdf#">
+  <RDF:Description RDF:about="urn:mozilla:install-manifest">
+    <em:targetApplication>
+      <RDF:Description>
+        <em:id>{ec8030f7-c20a-464f-9b0e-13a3a9e97384}</em:id>
+      </RDF:Description>
+    </em:targetApplication>
+    <em:id>
+      legacy@allizom.org
+    </em:id>
+  </RDF:Description>
+</RDF:RDF>`
+
+func Test_readXPIAddonID(t *testing.T) {
+	testXPI, err := os.ReadFile("integration_test/test.xpi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		input      []byte
+		expectedID string
+		wantErr    bool
+	}{
+		{
+			name:       "integration test XPI without an ID",
+			input:      testXPI,
+			expectedID: "",
+		},
+		{
+			name: "browser_specific_settings gecko ID",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"manifest_version": 2, "browser_specific_settings": {"gecko": {"id": "myaddon@allizom.org"}}}`,
+			}),
+			expectedID: "myaddon@allizom.org",
+		},
+		{
+			name: "applications gecko ID",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"manifest_version": 2, "applications": {"gecko": {"id": "myaddon@allizom.org"}}}`,
+			}),
+			expectedID: "myaddon@allizom.org",
+		},
+		{
+			name: "browser_specific_settings takes precedence over applications",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"browser_specific_settings": {"gecko": {"id": "new@allizom.org"}}, "applications": {"gecko": {"id": "old@allizom.org"}}}`,
+			}),
+			expectedID: "new@allizom.org",
+		},
+		{
+			name: "manifest.json with a byte order mark",
+			input: makeZip(t, map[string]string{
+				"manifest.json": "\xef\xbb\xbf" + `{"browser_specific_settings": {"gecko": {"id": "myaddon@allizom.org"}}}`,
+			}),
+			expectedID: "myaddon@allizom.org",
+		},
+		{
+			name: "manifest.json with comment lines",
+			input: makeZip(t, map[string]string{
+				"manifest.json": "// generated by the build\n{\n  \"manifest_version\": 2,\n  // the ID of the add-on\n  \"browser_specific_settings\": {\"gecko\": {\"id\": \"myaddon@allizom.org\"}}\n}\n",
+			}),
+			expectedID: "myaddon@allizom.org",
+		},
+		{
+			name: "install.rdf ID attribute",
+			input: makeZip(t, map[string]string{
+				"install.rdf": testInstallRDFAttr,
+			}),
+			expectedID: "legacy@allizom.org",
+		},
+		{
+			name: "install.rdf ID element ignores target application IDs",
+			input: makeZip(t, map[string]string{
+				"install.rdf": testInstallRDFElement,
+			}),
+			expectedID: "legacy@allizom.org",
+		},
+		{
+			name:    "not a zip file",
+			input:   []byte(";"),
+			wantErr: true,
+		},
+		{
+			name: "no manifest",
+			input: makeZip(t, map[string]string{
+				"background.js": "",
+			}),
+			wantErr: true,
+		},
+		{
+			name: "invalid manifest.json",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"browser_specific_settings": `,
+			}),
+			wantErr: true,
+		},
+		{
+			name: "invalid install.rdf",
+			input: makeZip(t, map[string]string{
+				"install.rdf": `<RDF><Description>`,
+			}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := readXPIAddonID(sectionReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readXPIAddonID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if id != tt.expectedID {
+				t.Fatalf("readXPIAddonID() = %q, expected %q", id, tt.expectedID)
+			}
+		})
+	}
+}
+
+func Test_validateXPIAddonID(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       []byte
+		addonID     string
+		expectedErr error
+	}{
+		{
+			name: "matching ID",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"browser_specific_settings": {"gecko": {"id": "myaddon@allizom.org"}}}`,
+			}),
+			addonID:     "myaddon@allizom.org",
+			expectedErr: nil,
+		},
+		{
+			name: "no ID in manifest",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"manifest_version": 2}`,
+			}),
+			addonID:     "myaddon@allizom.org",
+			expectedErr: nil,
+		},
+		{
+			name: "mismatched ID",
+			input: makeZip(t, map[string]string{
+				"manifest.json": `{"browser_specific_settings": {"gecko": {"id": "other@allizom.org"}}}`,
+			}),
+			addonID:     "myaddon@allizom.org",
+			expectedErr: errXPIAddonIDMismatch,
+		},
+		{
+			name: "mismatched legacy ID",
+			input: makeZip(t, map[string]string{
+				"install.rdf": testInstallRDFAttr,
+			}),
+			addonID:     "myaddon@allizom.org",
+			expectedErr: errXPIAddonIDMismatch,
+		},
+		{
+			name:        "invalid XPI",
+			input:       []byte(";"),
+			addonID:     "myaddon@allizom.org",
+			expectedErr: errXPIInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateXPIAddonID(sectionReader(tt.input), tt.addonID)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("validateXPIAddonID() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+		})
+	}
+}